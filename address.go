@@ -0,0 +1,52 @@
+package email
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// formatAddress checks the address header value is a valid RFC 5322 address, and returns it ready for the header:
+// non-ASCII display name encoded per RFC 2047 and the domain converted to punycode. ASCII values are kept as is.
+// Address with non-ASCII local part is kept as is, as it can be sent only with SMTPUTF8, RFC 6532.
+func formatAddress(value string) (string, error) {
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", err
+	}
+	if isASCII(value) {
+		return value, nil
+	}
+	address := addr.Address
+	if ascii, e := envelopeAddress(address, false); e == nil {
+		address = ascii
+	}
+	if addr.Name == "" {
+		return address, nil
+	}
+	return (&mail.Address{Name: addr.Name, Address: address}).String(), nil
+}
+
+// formatAddressList formats the addresses of the header, comma separated and folded
+// before the address which would make the line longer than maxHeaderLineLen
+func formatAddressList(header string, values []string) (string, error) {
+	buff := strings.Builder{}
+	lineLen := len(header) + len(": ")
+	for i, value := range values {
+		addr, err := formatAddress(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s address %q: %w", header, value, err)
+		}
+		if i > 0 {
+			buff.WriteString(",")
+			lineLen++
+			if lineLen+len(addr) > maxHeaderLineLen {
+				buff.WriteString("\n ")
+				lineLen = 1
+			}
+		}
+		buff.WriteString(addr)
+		lineLen += len(addr)
+	}
+	return buff.String(), nil
+}
@@ -0,0 +1,101 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatAddress(t *testing.T) {
+	tbl := []struct {
+		in, out string
+		err     bool
+	}{
+		{"user@example.com", "user@example.com", false},
+		{"John Doe <user@example.com>", "John Doe <user@example.com>", false},
+		{`"Doe, John" <user@example.com>`, `"Doe, John" <user@example.com>`, false},
+		{"Jürgen <j@example.com>", "=?utf-8?q?J=C3=BCrgen?= <j@example.com>", false},
+		{"Jürgen Müller <j@bücher.de>", "=?utf-8?q?J=C3=BCrgen_M=C3=BCller?= <j@xn--bcher-kva.de>", false},
+		{"user@bücher.de", "user@xn--bcher-kva.de", false},
+		{"пользователь@пример.рф", "пользователь@пример.рф", false},
+		{"Иван <пользователь@пример.рф>", "=?utf-8?q?=D0=98=D0=B2=D0=B0=D0=BD?= <пользователь@пример.рф>", false},
+		{"", "", true},
+		{"not an address", "", true},
+		{"user@", "", true},
+		{"user@example.com, other@example.com", "", true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := formatAddress(tt.in)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, out)
+		})
+	}
+}
+
+func TestFormatAddressList(t *testing.T) {
+	t.Run("short list on one line", func(t *testing.T) {
+		out, err := formatAddressList("To", []string{"a@example.com", "Jürgen <j@example.com>"})
+		require.NoError(t, err)
+		assert.Equal(t, "a@example.com,=?utf-8?q?J=C3=BCrgen?= <j@example.com>", out)
+	})
+
+	t.Run("long list folded", func(t *testing.T) {
+		to := make([]string, 0, 20)
+		for i := 0; i < 20; i++ {
+			to = append(to, fmt.Sprintf("recipient%02d@example.com", i))
+		}
+		out, err := formatAddressList("To", to)
+		require.NoError(t, err)
+		lines := strings.Split("To: "+out, "\n")
+		require.Greater(t, len(lines), 1)
+		for i, line := range lines {
+			assert.LessOrEqual(t, len(line), maxHeaderLineLen, line)
+			if i > 0 {
+				assert.True(t, strings.HasPrefix(line, " "), "continuation starts with whitespace: %q", line)
+			}
+		}
+		assert.Equal(t, strings.Join(to, ","), strings.ReplaceAll(out, "\n ", ""), "unfolded back to the list")
+	})
+
+	t.Run("address longer than the line", func(t *testing.T) {
+		long := strings.Repeat("a", 100) + "@example.com"
+		out, err := formatAddressList("To", []string{long, "b@example.com"})
+		require.NoError(t, err)
+		assert.Equal(t, long+",\n b@example.com", out, "not broken inside the address")
+	})
+
+	t.Run("invalid address", func(t *testing.T) {
+		_, err := formatAddressList("To", []string{"a@example.com", "bad"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid To address "bad": `)
+	})
+}
+
+func TestEmail_BuildMessageAddresses(t *testing.T) {
+	to := []string{"Jürgen Müller <j@example.com>"}
+	for i := 0; i < 10; i++ {
+		to = append(to, fmt.Sprintf("recipient%02d@example.com", i))
+	}
+	msg, err := NewSender("localhost").BuildMessage("body", Params{From: "Отдел продаж <sales@example.com>", To: to})
+	require.NoError(t, err)
+
+	parsed, err := ParseMessage(msg.Reader())
+	require.NoError(t, err)
+	require.Len(t, parsed.From, 1)
+	assert.Equal(t, "Отдел продаж", parsed.From[0].Name)
+	require.Len(t, parsed.To, len(to))
+	assert.Equal(t, "Jürgen Müller", parsed.To[0].Name)
+	assert.Equal(t, "recipient09@example.com", parsed.To[10].Address)
+
+	_, err = NewSender("localhost").BuildMessage("body", Params{From: "sales@example.com", To: []string{"to@example.com", "<broken"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid To address "<broken"`)
+}
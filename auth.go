@@ -2,7 +2,9 @@ package email
 
 import (
 	"errors"
+	"fmt"
 	"net/smtp"
+	"strings"
 )
 
 // authMethod is SMTP authentication method
@@ -10,10 +12,90 @@ type authMethod string
 
 // List of supported authentication methods
 const (
-	authMethodPlain authMethod = "PLAIN"
-	authMethodLogin authMethod = "LOGIN"
+	authMethodPlain    authMethod = "PLAIN"
+	authMethodLogin    authMethod = "LOGIN"
+	authMethodCRAMMD5  authMethod = "CRAM-MD5"
+	authMethodExternal authMethod = "EXTERNAL"
+	authMethodAuto     authMethod = "AUTO" // not a mechanism, picked from the server's AUTH extension on each send
 )
 
+// defaultAuthPreference is the order AutoAuth tries mechanisms in, strongest first.
+// CRAM-MD5 never sends the password, PLAIN and LOGIN send it as is and rely on TLS.
+var defaultAuthPreference = []authMethod{authMethodCRAMMD5, authMethodPlain, authMethodLogin}
+
+// supported tells if the package implements the mechanism
+func (m authMethod) supported() bool {
+	for _, s := range defaultAuthPreference {
+		if s == m {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionReporter is implemented by clients knowing the EHLO extensions of the server, like *smtp.Client
+type extensionReporter interface {
+	Extension(ext string) (bool, string)
+}
+
+// auth returns an smtp.Auth that implements SMTP authentication mechanism
+// depends on Sender settings. With AutoAuth the mechanism is picked from the ones
+// the server advertises to the client, which has to be greeted (and upgraded to TLS) already.
+func (em *Sender) auth(client SMTPClient) (smtp.Auth, error) {
+	if em.authMethod == authMethodExternal {
+		return &externalAuth{identity: em.authIdentity}, nil // credentials are in the client certificate
+	}
+	if em.smtpUserName == "" || em.smtpPassword == "" {
+		return nil, nil // no auth
+	}
+
+	method := em.authMethod
+	if method == authMethodAuto {
+		var err error
+		if method, err = em.negotiateAuth(client); err != nil {
+			return nil, err
+		}
+		em.logger.Logf("[DEBUG] auth mechanism %s selected for %s:%d", method, em.host, em.port)
+	}
+
+	switch method {
+	case authMethodLogin:
+		return newLoginAuth(em.smtpUserName, em.smtpPassword, em.host), nil
+	case authMethodCRAMMD5:
+		return smtp.CRAMMD5Auth(em.smtpUserName, em.smtpPassword), nil
+	default:
+		return smtp.PlainAuth("", em.smtpUserName, em.smtpPassword, em.host), nil
+	}
+}
+
+// negotiateAuth picks the first mechanism of the preference list advertised in the AUTH extension of the server
+func (em *Sender) negotiateAuth(client SMTPClient) (authMethod, error) {
+	reporter, ok := client.(extensionReporter)
+	if !ok {
+		return "", errors.New("can't negotiate auth mechanism, smtp client doesn't report server extensions")
+	}
+	supported, mechanisms := reporter.Extension("AUTH")
+	if !supported {
+		return "", errors.New("can't negotiate auth mechanism, server doesn't advertise AUTH")
+	}
+
+	offered := map[authMethod]bool{}
+	for _, m := range strings.Fields(mechanisms) {
+		offered[authMethod(strings.ToUpper(m))] = true
+	}
+
+	preference := em.authPreference
+	if len(preference) == 0 {
+		preference = defaultAuthPreference
+	}
+	for _, m := range preference {
+		if offered[m] && m.supported() {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("can't negotiate auth mechanism, none of %v offered by server, it supports %q", preference, mechanisms)
+}
+
 // newLoginAuth returns smtp.Auth that implements the LOGIN authentication
 // mechanism as defined in the LOGIN SASL Mechanism document,
 // https://www.ietf.org/archive/id/draft-murchison-sasl-login-00.txt.
@@ -58,3 +140,26 @@ func (a *loginAuth) Next(_ []byte, more bool) (toServer []byte, err error) {
 
 	return nil, nil
 }
+
+// externalAuth implements the EXTERNAL SASL mechanism, RFC 4422 appendix A.
+// The server takes the identity from the TLS client certificate, the optional
+// authorization identity asks to act as someone else than the certificate says.
+type externalAuth struct {
+	identity string
+}
+
+func (a *externalAuth) Start(server *smtp.ServerInfo) (proto string, toServer []byte, err error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return string(authMethodExternal), []byte(a.identity), nil
+}
+
+// Next answers the empty challenge of a server ignoring the initial response with nothing,
+// i.e. no authorization identity, as net/smtp sends AUTH EXTERNAL without an initial response when the identity is empty
+func (a *externalAuth) Next(_ []byte, more bool) (toServer []byte, err error) {
+	if more {
+		return []byte{}, nil // not nil, net/smtp sends nothing at all for nil
+	}
+	return nil, nil
+}
@@ -1,9 +1,20 @@
 package email
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
 	"net/smtp"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/email/mocks"
 )
 
 func TestLoginAuth(t *testing.T) {
@@ -79,3 +90,132 @@ func TestLoginAuth_Start(t *testing.T) {
 		}
 	}
 }
+
+// extensionClient is an SMTPClient reporting the given AUTH extension, like *smtp.Client does after EHLO
+type extensionClient struct {
+	*mocks.SMTPClientMock
+	auth string // AUTH parameters, empty for a server without AUTH
+}
+
+func (c extensionClient) Extension(ext string) (supported bool, params string) {
+	if ext != "AUTH" || c.auth == "" {
+		return false, ""
+	}
+	return true, c.auth
+}
+
+func TestSender_negotiateAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		preferred []string
+		client    SMTPClient
+		want      authMethod
+		wantErr   string
+	}{
+		{name: "strongest by default", client: extensionClient{auth: "LOGIN PLAIN CRAM-MD5"}, want: authMethodCRAMMD5},
+		{name: "plain over login by default", client: extensionClient{auth: "LOGIN PLAIN"}, want: authMethodPlain},
+		{name: "login only", client: extensionClient{auth: "LOGIN"}, want: authMethodLogin},
+		{name: "case insensitive", client: extensionClient{auth: "login plain"}, want: authMethodPlain},
+		{name: "custom preference", preferred: []string{"login", "PLAIN"}, client: extensionClient{auth: "PLAIN LOGIN"},
+			want: authMethodLogin},
+		{name: "custom preference skips unsupported", preferred: []string{"XOAUTH2", "PLAIN"},
+			client: extensionClient{auth: "XOAUTH2 PLAIN"}, want: authMethodPlain},
+		{name: "nothing in common", client: extensionClient{auth: "XOAUTH2 GSSAPI"},
+			wantErr: "none of [CRAM-MD5 PLAIN LOGIN] offered by server, it supports \"XOAUTH2 GSSAPI\""},
+		{name: "no AUTH extension", client: extensionClient{}, wantErr: "server doesn't advertise AUTH"},
+		{name: "client without extensions", client: &mocks.SMTPClientMock{}, wantErr: "doesn't report server extensions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSender("localhost", Auth("user", "pass"), AutoAuth(tt.preferred...))
+			got, err := s.negotiateAuth(tt.client)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSender_authAuto(t *testing.T) {
+	logBuff := bytes.NewBuffer(nil)
+	logger := &mocks.LoggerMock{LogfFunc: func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(logBuff, format+"\n", args...)
+	}}
+
+	s := NewSender("localhost", Auth("user", "pass"), AutoAuth(), Log(logger))
+	auth, err := s.auth(extensionClient{auth: "PLAIN LOGIN"})
+	require.NoError(t, err)
+	proto, _, err := auth.Start(&smtp.ServerInfo{Name: "localhost", TLS: true, Auth: []string{"PLAIN", "LOGIN"}})
+	require.NoError(t, err)
+	assert.Equal(t, "PLAIN", proto)
+	assert.Contains(t, logBuff.String(), "[DEBUG] auth mechanism PLAIN selected for localhost:25")
+
+	s = NewSender("localhost", AutoAuth())
+	auth, err = s.auth(&mocks.SMTPClientMock{})
+	require.NoError(t, err, "no credentials, nothing to negotiate")
+	assert.Nil(t, auth)
+}
+
+func TestEmail_SendAutoAuth(t *testing.T) {
+	host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+		if err := writeSMTPResponse(conn, "220 smtp.example.net ESMTP ready"); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		if _, err := readSMTPCommand(reader); err != nil { // EHLO
+			return err
+		}
+		if _, err := io.WriteString(conn, "250-smtp.example.net\r\n250 AUTH LOGIN PLAIN\r\n"); err != nil {
+			return err
+		}
+		cmd, err := readSMTPCommand(reader)
+		if err != nil {
+			return err
+		}
+		if want := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00pass")); cmd != want {
+			return fmt.Errorf("unexpected auth command %q, want %q", cmd, want)
+		}
+		if err = writeSMTPResponse(conn, "235 authenticated"); err != nil {
+			return err
+		}
+		cmd, err = readSMTPCommand(reader)
+		if err != nil {
+			return err
+		}
+		if cmd != "MAIL FROM:<from@example.com>" {
+			return fmt.Errorf("unexpected command %q", cmd)
+		}
+		return writeSMTPResponse(conn, "530 stop here")
+	})
+
+	sender := NewSender(host, Port(port), Auth("user", "pass"), AutoAuth(), TimeOut(time.Second*5))
+	err := sender.Send("test body", Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stop here", "auth passed, the transaction went on to MAIL")
+	waitSMTPTestServer(t, done)
+}
+
+func TestExternalAuth(t *testing.T) {
+	auth := &externalAuth{identity: "someone@example.com"}
+	proto, resp, err := auth.Start(&smtp.ServerInfo{Name: "servername", TLS: true})
+	require.NoError(t, err)
+	assert.Equal(t, "EXTERNAL", proto)
+	assert.Equal(t, []byte("someone@example.com"), resp)
+
+	resp, err = auth.Next([]byte{}, true)
+	require.NoError(t, err)
+	assert.Empty(t, resp)
+
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "localhost"})
+	require.EqualError(t, err, "unencrypted connection", "no client certificate without TLS")
+
+	s := NewSender("localhost", ExternalAuth(""))
+	a, err := s.auth(nil)
+	require.NoError(t, err, "no username and password needed")
+	assert.IsType(t, &externalAuth{}, a)
+}
@@ -0,0 +1,123 @@
+package email
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned without trying the server while the circuit breaker is open
+type CircuitOpenError struct {
+	Failures   int           // consecutive failures which opened the circuit
+	RetryAfter time.Duration // time until a probe send is allowed
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open after %d consecutive failures, retry after %v", e.Failures, e.RetryAfter)
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops sending after threshold consecutive connection failures or 4xx replies for the cool-down,
+// then lets a single probe send through, closing on its success and opening again on its failure
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	state     circuitState
+	failures  int       // consecutive failures
+	openUntil time.Time // end of the cool-down of open circuit
+	probing   bool      // probe send of half-open circuit is in progress
+}
+
+// allow checks if the send may go to the server, nil breaker allows everything
+func (b *circuitBreaker) allow(now time.Time, logger Logger) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen && !now.Before(b.openUntil) {
+		b.setState(circuitHalfOpen, logger)
+	}
+	switch {
+	case b.state == circuitOpen:
+		return &CircuitOpenError{Failures: b.failures, RetryAfter: b.openUntil.Sub(now)}
+	case b.state == circuitHalfOpen && b.probing:
+		return &CircuitOpenError{Failures: b.failures} // probe in progress, retry right after it
+	case b.state == circuitHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the outcome of the allowed send. Connection failures and 4xx replies count,
+// anything else means the server works, and the send interrupted by the context tells nothing.
+func (b *circuitBreaker) done(err error, interrupted bool, now time.Time, logger Logger) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	switch {
+	case err != nil && (interrupted || notTried(err)):
+		return
+	case err == nil || !temporaryFailure(err):
+		b.failures = 0
+		b.setState(circuitClosed, logger)
+	case b.state == circuitHalfOpen:
+		b.failures++
+		b.openUntil = now.Add(b.coolDown)
+		b.setState(circuitOpen, logger)
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = now.Add(b.coolDown)
+			b.setState(circuitOpen, logger)
+		}
+	}
+}
+
+// skip records the allowed send didn't reach the server, letting the next probe through
+func (b *circuitBreaker) skip() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// setState changes the state and reports the change, should be called under lock
+func (b *circuitBreaker) setState(state circuitState, logger Logger) {
+	if b.state == state {
+		return
+	}
+	switch state {
+	case circuitOpen:
+		logger.Logf("[WARN] circuit breaker %s, %d consecutive failures, cool-down %v", state, b.failures, b.coolDown)
+	default:
+		logger.Logf("[INFO] circuit breaker %s, was %s", state, b.state)
+	}
+	b.state = state
+}
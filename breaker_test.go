@@ -0,0 +1,173 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_CircuitBreaker(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}
+
+	var dials int32
+	var up atomic.Value
+	up.Store(false)
+	servers := newMXTestServers(map[string]string{"relay.example.com:25": "250 ok"})
+	dial := DialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		if !up.Load().(bool) {
+			return nil, errors.New("connection refused")
+		}
+		return servers.dial()(ctx, network, address)
+	})
+	logBuff := bytes.NewBuffer(nil)
+	s := NewSender("relay.example.com", dial, CircuitBreaker(2, time.Minute), Log(newTestLogger(logBuff)))
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	s.timeNow = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		err := s.SendContext(context.Background(), "test body", params)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+	}
+	assert.Contains(t, logBuff.String(), "[WARN] circuit breaker open, 2 consecutive failures, cool-down 1m0s")
+
+	err := s.SendContext(context.Background(), "test body", params)
+	var openErr *CircuitOpenError
+	require.ErrorAs(t, err, &openErr)
+	assert.EqualError(t, err, "circuit breaker open after 2 consecutive failures, retry after 1m0s")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials), "no dial while open")
+
+	// probe fails, open again
+	now = now.Add(time.Minute)
+	err = s.SendContext(context.Background(), "test body", params)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.Contains(t, logBuff.String(), "[INFO] circuit breaker half-open, was open")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+	now = now.Add(30 * time.Second)
+	require.ErrorAs(t, s.SendContext(context.Background(), "test body", params), &openErr)
+	assert.Equal(t, 3, openErr.Failures)
+	assert.Equal(t, 30*time.Second, openErr.RetryAfter)
+
+	// probe succeeds, closed
+	now = now.Add(30 * time.Second)
+	up.Store(true)
+	require.NoError(t, s.SendContext(context.Background(), "test body", params))
+	assert.Contains(t, logBuff.String(), "[INFO] circuit breaker closed, was half-open")
+	require.NoError(t, s.SendContext(context.Background(), "test body", params))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&dials))
+}
+
+func TestEmail_CircuitBreakerBeforeBuild(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}
+	relay, client := newTestRelay("relay.example.com", &textproto.Error{Code: 421, Msg: "busy"})
+	s := NewSender("relay.example.com", SMTP(relay.smtpClient), CircuitBreaker(1, time.Minute))
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	s.timeNow = func() time.Time { return now }
+	require.Error(t, s.SendContext(context.Background(), "test body", params))
+
+	bad := params
+	bad.Attachments = []string{"testdata/no-such-file"}
+	_, err := s.Deliver(context.Background(), "test body", bad)
+	var openErr *CircuitOpenError
+	require.ErrorAs(t, err, &openErr, "fails fast, before the message is built")
+	var phErr *phaseError
+	require.ErrorAs(t, err, &phErr)
+	assert.Equal(t, phaseCircuitBreaker, phErr.phase)
+
+	now = now.Add(time.Minute)
+	_, err = s.Deliver(context.Background(), "test body", bad)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't make email message", "probe allowed")
+	err = s.SendContext(context.Background(), "test body", params)
+	assert.False(t, errors.As(err, &openErr), "the probe which failed to build doesn't hold the next one")
+	assert.Len(t, client.MailCalls(), 2)
+}
+
+func TestEmail_CircuitBreakerTransports(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}
+
+	t.Run("route transport", func(t *testing.T) {
+		_, internalClient := newTestRelay("internal.example.com", &textproto.Error{Code: 421, Msg: "busy"})
+		internal := NewSender("internal.example.com", SMTP(internalClient), CircuitBreaker(1, time.Minute))
+		s := NewSender("localhost", SMTP(newTestSMTPClient()), CircuitBreaker(2, time.Minute),
+			Route("example.com", internal))
+
+		require.Error(t, s.SendContext(context.Background(), "test body", params))
+		err := s.SendContext(context.Background(), "test body", params)
+		var openErr *CircuitOpenError
+		require.ErrorAs(t, err, &openErr, "breaker of the route transport open")
+		assert.Len(t, internalClient.MailCalls(), 1)
+		assert.Equal(t, 1, s.breaker.failures, "transport's open circuit is not a failure of the sender")
+	})
+
+	t.Run("failover relay", func(t *testing.T) {
+		_, flakyClient := newTestRelay("flaky.example.net", &textproto.Error{Code: 421, Msg: "busy"})
+		flaky := NewSender("flaky.example.net", SMTP(flakyClient), CircuitBreaker(1, time.Minute))
+		backup, backupClient := newTestRelay("backup.example.net", nil)
+		primary, _ := newTestRelay("primary.example.net", &textproto.Error{Code: 421, Msg: "busy"})
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("primary.example.net", SMTP(primary.smtpClient), Log(newTestLogger(logBuff)),
+			Failover(0, flaky, backup))
+
+		for i := 0; i < 2; i++ {
+			res, err := s.Deliver(context.Background(), "test body", params)
+			require.NoError(t, err)
+			assert.Equal(t, "backup.example.net:25", res.Relay)
+		}
+		assert.Len(t, flakyClient.MailCalls(), 1, "relay with open circuit skipped")
+		assert.Len(t, backupClient.MailCalls(), 2)
+		assert.Contains(t, logBuff.String(), "[WARN] relay flaky.example.net:25 skipped, circuit breaker open")
+	})
+}
+
+func TestCircuitBreaker_done(t *testing.T) {
+	now := time.Now()
+	logger := newTestLogger(bytes.NewBuffer(nil))
+	temporary := &textproto.Error{Code: 451, Msg: "try later"}
+
+	t.Run("permanent error resets failures", func(t *testing.T) {
+		b := &circuitBreaker{threshold: 2, coolDown: time.Minute}
+		b.done(temporary, false, now, logger)
+		b.done(&textproto.Error{Code: 550, Msg: "no such user"}, false, now, logger)
+		b.done(temporary, false, now, logger)
+		assert.Equal(t, circuitClosed, b.state)
+		assert.Equal(t, 1, b.failures)
+	})
+
+	t.Run("interrupted send doesn't count", func(t *testing.T) {
+		b := &circuitBreaker{threshold: 1, coolDown: time.Minute}
+		b.done(context.Canceled, true, now, logger)
+		assert.Equal(t, circuitClosed, b.state)
+		assert.Zero(t, b.failures)
+	})
+
+	t.Run("single probe while half-open", func(t *testing.T) {
+		b := &circuitBreaker{threshold: 1, coolDown: time.Minute}
+		b.done(temporary, false, now, logger)
+		require.Equal(t, circuitOpen, b.state)
+
+		later := now.Add(time.Minute)
+		require.NoError(t, b.allow(later, logger))
+		var openErr *CircuitOpenError
+		require.ErrorAs(t, b.allow(later, logger), &openErr, "second send waits for the probe")
+		b.done(context.Canceled, true, later, logger)
+		assert.Equal(t, circuitHalfOpen, b.state)
+		assert.NoError(t, b.allow(later, logger), "interrupted probe lets the next one through")
+	})
+
+	t.Run("nil breaker", func(t *testing.T) {
+		var b *circuitBreaker
+		assert.NoError(t, b.allow(now, logger))
+		b.done(temporary, false, now, logger)
+	})
+}
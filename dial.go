@@ -0,0 +1,82 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DialContextFunc connects to the address on the named network, like net.Dialer.DialContext
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dial connects to the server with the configured dialer, through the proxy if set, and makes the TLS handshake
+// with TLS option. TimeOut limits the whole connection setup, including the proxy and TLS handshakes.
+func (em *Sender) dial(ctx context.Context, network, address string, tlsConf *tls.Config) (net.Conn, error) {
+	if network == "unix" && em.proxy.scheme != "" {
+		return nil, fmt.Errorf("can't connect to unix socket %s through %s proxy", address, em.proxy.scheme)
+	}
+	dial, err := em.dialer(network)
+	if err != nil {
+		return nil, err
+	}
+
+	if em.timeOut > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, em.timeOut)
+		defer cancel() // the deadline is for the connection setup only, the returned connection isn't bound to ctx
+	}
+
+	start := time.Now()
+	conn, err := dial(ctx, network, address)
+	em.observe(ctx, PhaseDial, start, err)
+	if err != nil {
+		if em.tls {
+			return nil, fmt.Errorf("failed to dial smtp tls to %s: %w", address, err)
+		}
+		return nil, fmt.Errorf("timeout connecting to %s: %w", address, err)
+	}
+	if !em.tls {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, tlsConf)
+	start = time.Now()
+	err = tlsConn.HandshakeContext(ctx)
+	em.observe(ctx, PhaseTLS, start, err)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to dial smtp tls to %s: %w", address, err)
+	}
+	return tlsConn, nil
+}
+
+// dialer returns the function making connections: the custom one set with DialContext or net.Dialer
+// bound to the source address, wrapped with the proxy handshake if proxy set
+func (em *Sender) dialer(network string) (DialContextFunc, error) {
+	dial := em.dialContext
+	if dial == nil {
+		d := &net.Dialer{Timeout: em.timeOut}
+		if em.sourceAddr != "" && network == "tcp" {
+			ip := net.ParseIP(em.sourceAddr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source address %q", em.sourceAddr)
+			}
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		dial = d.DialContext
+	}
+
+	switch em.proxy.scheme {
+	case "":
+		return dial, nil
+	case proxySOCKS5:
+		em.logger.Logf("[DEBUG] connecting through socks5 proxy %s", em.proxy.address)
+		return em.proxy.socks5(dial), nil
+	case proxyHTTP:
+		em.logger.Logf("[DEBUG] connecting through http proxy %s", em.proxy.address)
+		return em.proxy.httpConnect(dial), nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", em.proxy.scheme)
+}
@@ -0,0 +1,123 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_ClientDialContext(t *testing.T) {
+	host, port, done := startSMTPTestServer(t, greetAndQuitSMTPHandler(nil))
+
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		_, hasDeadline := ctx.Deadline()
+		if !hasDeadline {
+			return nil, errors.New("no connection timeout")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+
+	s := NewSender(host, Port(port), DialContext(dial), SourceAddr("ignored with custom dialer"))
+	client, _, err := s.client(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, client.Quit())
+	waitSMTPTestServer(t, done)
+	assert.Equal(t, []string{"tcp " + net.JoinHostPort(host, strconv.Itoa(port))}, dialed)
+}
+
+func TestEmail_ClientDialContextTLS(t *testing.T) {
+	serverTLS := smtpTestTLSConfig(t)
+	host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+		tlsConn := tls.Server(conn, serverTLS)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		return greetAndQuitSMTPHandler(nil)(tlsConn)
+	})
+
+	var called bool
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		called = true
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	s := NewSender(host, Port(port), TLS(true), InsecureSkipVerify(true), DialContext(dial))
+	client, _, err := s.client(context.Background(), nil)
+	require.NoError(t, err)
+	_, isTLS := client.TLSConnectionState()
+	assert.True(t, isTLS, "tls handshake made over the custom connection")
+	require.NoError(t, client.Quit())
+	waitSMTPTestServer(t, done)
+	assert.True(t, called)
+}
+
+func TestEmail_ClientDialContextFailed(t *testing.T) {
+	dial := func(context.Context, string, string) (net.Conn, error) { return nil, errors.New("no route") }
+
+	_, _, err := NewSender("smtp.example.net", DialContext(dial)).client(context.Background(), nil)
+	require.EqualError(t, err, "timeout connecting to smtp.example.net:25: no route")
+
+	_, _, err = NewSender("smtp.example.net", Port(465), TLS(true), DialContext(dial)).client(context.Background(), nil)
+	require.EqualError(t, err, "failed to dial smtp tls to smtp.example.net:465: no route")
+
+	// the dialer which doesn't give up on its own is stopped by TimeOut
+	stalled := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	st := time.Now()
+	_, _, err = NewSender("smtp.example.net", DialContext(stalled), TimeOut(100*time.Millisecond)).client(context.Background(), nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(st), time.Second)
+}
+
+func TestEmail_ClientSourceAddr(t *testing.T) {
+	var remote string
+	host, port, done := startSMTPTestServer(t, greetAndQuitSMTPHandler(func(conn net.Conn) { remote = conn.RemoteAddr().String() }))
+
+	client, _, err := NewSender(host, Port(port), SourceAddr("127.0.0.1")).client(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, client.Quit())
+	waitSMTPTestServer(t, done)
+	remoteHost, _, err := net.SplitHostPort(remote)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", remoteHost)
+
+	_, _, err = NewSender(host, Port(port), SourceAddr("bad-ip")).client(context.Background(), nil)
+	require.EqualError(t, err, `invalid source address "bad-ip"`)
+}
+
+// greetAndQuitSMTPHandler makes a server handler greeting, answering EHLO and QUIT,
+// onConnect is called with the connection first if set
+func greetAndQuitSMTPHandler(onConnect func(net.Conn)) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		if onConnect != nil {
+			onConnect(conn)
+		}
+		if err := writeSMTPResponse(conn, "220 smtp.example.net ESMTP ready"); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		cmd, err := readSMTPCommand(reader)
+		if err != nil {
+			return err
+		}
+		if cmd != "EHLO localhost" {
+			return fmt.Errorf("unexpected greeting %q", cmd)
+		}
+		if err := writeSMTPResponse(conn, "250 smtp.example.net"); err != nil {
+			return err
+		}
+		return expectSMTPQuit(conn, reader)
+	}
+}
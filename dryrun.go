@@ -0,0 +1,70 @@
+package email
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"strings"
+)
+
+// dryRun makes the checks of the send which need no server: addresses, TLS settings and auth,
+// and returns the result the send would have if the server accepted the message
+func (em *Sender) dryRun(msg *payload, params Params) (*Result, error) {
+	if _, err := mail.ParseAddress(strings.TrimSpace(params.From)); err != nil && params.From != "" { // null reverse-path is fine
+		return nil, withPhase(phaseMail, fmt.Errorf("bad from address %q: %w", params.From, err))
+	}
+	res := &Result{Recipients: make([]RecipientStatus, 0, len(params.To))}
+	for _, rcpt := range params.To {
+		addr, err := mail.ParseAddress(strings.TrimSpace(rcpt))
+		if err != nil {
+			return nil, withPhase(phaseRcpt, fmt.Errorf("bad to address %q: %w", rcpt, err))
+		}
+		res.Recipients = append(res.Recipients, RecipientStatus{Address: addr.Address})
+	}
+
+	if em.tls || em.starttls != StartTLSNever {
+		if _, err := em.tlsConfig(); err != nil {
+			return nil, withPhase(phaseConnect, fmt.Errorf("failed to make smtp client: %w", err))
+		}
+	}
+	if err := em.dryRunAuth(); err != nil {
+		return nil, withPhase(phaseAuth, fmt.Errorf("failed to auth to smtp %s:%d, %w", em.host, em.port, err))
+	}
+
+	res.Relay = em.dryRunRelay(res.Recipients)
+	em.logger.Logf("[INFO] dry run, email from %s to %v built, %d bytes, not sent", params.From, params.To, msg.size)
+	return res, nil
+}
+
+// dryRunAuth starts the auth as the server would, to check the connection is encrypted as the mechanism requires.
+// Connection with opportunistic STARTTLS is assumed to be encrypted. Mechanism for AutoAuth is picked by the server,
+// so it's not checked.
+func (em *Sender) dryRunAuth() error {
+	if em.authMethod == authMethodAuto {
+		return nil
+	}
+	auth, err := em.auth(nil)
+	if err != nil || auth == nil {
+		return err
+	}
+	info := &smtp.ServerInfo{Name: em.host, TLS: em.tls || em.starttls != StartTLSNever}
+	_, _, err = auth.Start(info)
+	return err
+}
+
+// dryRunRelay returns the servers the recipients would be sent through, comma separated like for a routed send.
+// Exchangers of DirectMX are not known without DNS lookup, they are not listed.
+func (em *Sender) dryRunRelay(recipients []RecipientStatus) string {
+	relays := []string{}
+	seen := map[*Sender]bool{}
+	for _, rcpt := range recipients {
+		transport := em.routeOf(rcpt.Address)
+		if seen[transport] || transport.mxResolver != nil {
+			continue
+		}
+		seen[transport] = true
+		_, addr := transport.serverAddress()
+		relays = append(relays, addr)
+	}
+	return strings.Join(relays, ", ")
+}
@@ -0,0 +1,95 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_DryRun(t *testing.T) {
+	params := Params{From: "Me <from@example.com>", To: []string{"to@example.com", `"Two" <to2@example.org>`}, Subject: "subj"}
+
+	t.Run("built, not sent", func(t *testing.T) {
+		client := newTestSMTPClient()
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("smtp.example.com", SMTP(client), DryRun(true), Auth("user", "pass"), STARTTLS(true),
+			Log(newTestLogger(logBuff)))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, &Result{Relay: "smtp.example.com:25",
+			Recipients: []RecipientStatus{{Address: "to@example.com"}, {Address: "to2@example.org"}}}, res)
+		assert.Empty(t, client.MailCalls())
+		assert.Len(t, client.CloseCalls(), 1)
+		assert.Regexp(t, `\[INFO\] dry run, email from Me <from@example.com> to \[.+\] built, \d+ bytes, not sent`, logBuff.String())
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		internal := NewSender("internal.example.com", Port(2525))
+		mx := NewSender("", DirectMX(mxTestResolver{}))
+		s := NewSender("smtp.example.com", DryRun(true), Route("example.org", internal), Route("*.example.net", mx))
+
+		res, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com",
+			To: []string{"a@example.org", "b@example.com", "c@example.org", "d@mail.example.net"}})
+		require.NoError(t, err)
+		assert.Equal(t, "internal.example.com:2525, smtp.example.com:25", res.Relay)
+		assert.Len(t, res.Recipients, 4)
+	})
+
+	t.Run("dry run route transport", func(t *testing.T) {
+		_, internalClient := newTestRelay("internal.example.com", nil)
+		internal := NewSender("internal.example.com", SMTP(internalClient), DryRun(true))
+		_, espClient := newTestRelay("smtp.example.com", nil)
+		s := NewSender("smtp.example.com", SMTP(espClient), Route("example.org", internal))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, "smtp.example.com:25, internal.example.com:25", res.Relay)
+		assert.Empty(t, internalClient.MailCalls(), "route transport in dry run sends nothing")
+		assert.Len(t, espClient.MailCalls(), 1)
+	})
+
+	t.Run("message errors", func(t *testing.T) {
+		s := NewSender("smtp.example.com", DryRun(true))
+		_, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com", To: []string{"to@example.com"},
+			Attachments: []string{"testdata/no-such-file"}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't make email message")
+	})
+
+	t.Run("address errors", func(t *testing.T) {
+		s := NewSender("smtp.example.com", DryRun(true))
+		_, err := s.Deliver(context.Background(), "test body", Params{From: "not an address", To: []string{"to@example.com"}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid From address "not an address"`, "rejected while building")
+
+		_, err = s.Deliver(context.Background(), "test body", Params{From: "from@example.com", To: []string{"to@example.com", "bad"}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid To address "bad"`)
+
+		err = s.SendRaw(context.Background(), "from@example.com", []string{"bad"}, strings.NewReader("Subject: raw\n\nbody"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `bad to address "bad"`, "raw message isn't built, the envelope is checked")
+	})
+
+	t.Run("auth without tls", func(t *testing.T) {
+		s := NewSender("smtp.example.com", DryRun(true), Auth("user", "pass"))
+		_, err := s.Deliver(context.Background(), "test body", params)
+		require.EqualError(t, err, "failed to auth to smtp smtp.example.com:25, unencrypted connection")
+
+		s = NewSender("smtp.example.com", DryRun(true), Auth("user", "pass"), AutoAuth("CRAM-MD5"))
+		_, err = s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err, "mechanism picked by the server is not checked")
+	})
+
+	t.Run("tls settings", func(t *testing.T) {
+		s := NewSender("smtp.example.com", DryRun(true), TLS(true), ClientCertificate("testdata/no-cert.pem", "testdata/no-key.pem"))
+		_, err := s.Deliver(context.Background(), "test body", params)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't load client certificate")
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -32,30 +33,106 @@ import (
 type Sender struct {
 	smtpClient         SMTPClient
 	logger             Logger
-	host               string     // SMTP host
-	heloHost           string     // SMTP HELO/EHLO host
-	port               int        // SMTP port
-	contentType        string     // content type, optional. Will trigger MIME and Content-Type headers
-	tls                bool       // TLS auth
-	starttls           bool       // startTLS
-	insecureSkipVerify bool       // insecure Skip Verify
-	smtpUserName       string     // username
-	smtpPassword       string     // password
-	authMethod         authMethod // auth method
+	host               string         // SMTP host
+	heloHost           string         // SMTP HELO/EHLO host
+	port               int            // SMTP port
+	contentType        string         // content type, optional. Will trigger MIME and Content-Type headers
+	tls                bool           // TLS auth
+	starttls           StartTLSPolicy // startTLS
+	insecureSkipVerify bool           // insecure Skip Verify
+	smtpUserName       string         // username
+	smtpPassword       string         // password
+	authMethod         authMethod     // auth method
+	authPreference     []authMethod   // mechanisms tried by AutoAuth, in order
+	authIdentity       string         // authorization identity for EXTERNAL auth
 	timeOut            time.Duration
 	contentCharset     string
 	timeNow            func() time.Time
+	randomID           func() string // unique part of Message-ID
+
+	// tls settings, applied to both TLS and STARTTLS
+	customTLS      *tls.Config // base config set with TLSConfig, cloned for each connection
+	clientCertFile string      // client certificate PEM file
+	clientKeyFile  string      // client certificate key PEM file
+	getClientCert  func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	rootCAs        *x509.CertPool
+	tlsPins        []string // base64 SHA-256 hashes of pinned server public keys
+
+	// connection settings
+	dialContext DialContextFunc // custom dial function, net.Dialer if not set
+	sourceAddr  string          // local IP address to bind the default dialer to
+	proxy       proxyConfig     // SOCKS5 or HTTP CONNECT proxy, none if scheme is empty
+	unixSocket  string          // unix socket path, connects to it instead of host and port if set
+	lmtp        bool            // speak LMTP instead of SMTP
+
+	// failover relays, tried in order after the host of the sender itself
+	relays        []*Sender
+	relayCoolDown time.Duration // time a failed relay is skipped for
+	relayState    *relayState   // failed relays with the time they are skipped until
+
+	mxResolver Resolver // delivers straight to the recipients' mail exchangers if set
+	routes     []route  // transports for the recipients matching the patterns, in order
+
+	rateLimiter *rateLimiter    // messages rate limit, none if nil
+	breaker     *circuitBreaker // fails fast while the server is down, none if nil
+
+	bodyLog    BodyLogMode    // how much of the message text is logged
+	bodyLogSet bool           // LogBody set explicitly, the structured events have no body otherwise
+	events     eventLogger    // structured events of the sends, none if nil
+	transcript TranscriptMode // where the SMTP conversation goes, not recorded if zero
+	observer   Observer       // gets the outcome of each phase, none if nil
+
+	middlewares []Middleware  // wrap Deliver, the first one is the outermost
+	staging     stagingPolicy // recipients allowlist and redirect, for non-production environments
+	dryRunMode  bool          // build and check messages, without sending
+	streaming   bool          // encode the files while sending, instead of building the message in memory
+
+	maxMessageSize    int64 // bytes, with the files encoded, no limit if zero
+	maxAttachmentSize int64 // bytes of each file, no limit if zero
+}
+
+// Result is the outcome of a delivery
+type Result struct {
+	Relay      string            // address of the server which accepted the message, host:port or socket path
+	Recipients []RecipientStatus // envelope recipients, in the order given
+}
+
+// RecipientStatus is the delivery status of a single recipient. SMTP server replies to the message
+// once for all recipients, so only LMTP fills Code and Message, with the reply given to the recipient.
+type RecipientStatus struct {
+	Address string // envelope address
+	Code    int    // reply code, zero if the server doesn't reply for each recipient
+	Message string // reply text
+	Err     error  // nil if the message was accepted for the recipient
+}
+
+// RecipientsError is returned when the server accepted the message for some recipients and rejected for others
+type RecipientsError struct {
+	Recipients []RecipientStatus // all recipients, the failed ones with Err set
+}
+
+func (e *RecipientsError) Error() string {
+	failed := []string{}
+	for _, r := range e.Recipients {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.Address, r.Err))
+		}
+	}
+	return fmt.Sprintf("rejected for %d of %d recipients, %s", len(failed), len(e.Recipients), strings.Join(failed, "; "))
 }
 
 // Params contains all user-defined parameters to send emails
 type Params struct {
-	From            string   // from email field
-	To              []string // from email field
-	Subject         string   // email subject
-	UnsubscribeLink string   // POST, https://support.google.com/mail/answer/81126 -> "Use one-click unsubscribe"
-	InReplyTo       string   // identifier for email group (category), used for email grouping
-	Attachments     []string // attachments path
-	InlineImages    []string // InlineImages images path
+	From            string            // from email field
+	To              []string          // from email field
+	Subject         string            // email subject
+	UnsubscribeLink string            // POST, https://support.google.com/mail/answer/81126 -> "Use one-click unsubscribe"
+	InReplyTo       string            // identifier for email group (category), used for email grouping
+	Attachments     []string          // attachments path
+	InlineImages    []string          // InlineImages images path
+	Headers         map[string]string // extra headers, like the ones added by a middleware, in the order of the names
+
+	originalTo []string // recipients replaced with RedirectAll, for X-Original-To header
 }
 
 // Logger is used to log errors and debug messages
@@ -89,6 +166,7 @@ func NewSender(smtpHost string, options ...Option) *Sender {
 		contentCharset:     "UTF-8",
 		timeOut:            time.Second * 30,
 		timeNow:            time.Now,
+		randomID:           randomID,
 	}
 	for _, opt := range options {
 		opt(&res)
@@ -112,78 +190,243 @@ func (em *Sender) Send(text string, params Params) error {
 // Note that a client set that way owns its connection, so such a transaction can't be terminated in the middle.
 // Always closes client on completion or failure.
 func (em *Sender) SendContext(ctx context.Context, text string, params Params) error {
-	em.logger.Logf("[DEBUG] send %q to %v", text, params.To)
+	_, err := em.Deliver(ctx, text, params)
+	return err
+}
 
-	client := em.smtpClient // set by the SMTP option, nil when SendContext makes its own client below
+// Deliver sends email like SendContext does and reports the delivery status of each recipient.
+// With LMTP the server accepts or rejects the message for each recipient on its own,
+// if it rejects it for some of them, the result is returned along with *RecipientsError.
+// Middlewares set with the Middlewares option wrap it.
+func (em *Sender) Deliver(ctx context.Context, text string, params Params) (*Result, error) {
+	return em.chain(em.deliverLogged)(ctx, text, params)
+}
 
-	var quit bool
-	defer func() {
-		if quit || client == nil { // quit set if Quit() call passed because it's closing connection as well.
-			return
-		}
-		if e := client.Close(); e != nil {
-			em.logger.Logf("[WARN] can't close smtp connection, %v", e)
-		}
-	}()
+// deliverLogged is the end of the middleware chain, delivering the message and logging it
+func (em *Sender) deliverLogged(ctx context.Context, text string, params Params) (*Result, error) {
+	em.logger.Logf("[DEBUG] send %s to %v", em.loggedBody(text), params.To)
 
-	if err := ctx.Err(); err != nil { // nothing started yet, a client set with the SMTP option is closed by the defer
-		return err
+	rcpts := len(params.To)
+	params, err := em.applyStaging(params)
+	if err != nil {
+		em.closeSMTPClient()
+		return nil, err
+	}
+	if rcpts > 0 && len(params.To) == 0 {
+		em.closeSMTPClient()
+		return &Result{}, nil // all the recipients dropped by the allowlist, nothing to send
+	}
+
+	start := time.Now()
+	res, msg, err := em.deliver(ctx, text, params)
+	em.logDelivery(ctx, params, func() []eventAttr { return em.bodyAttrs(text) }, msg, res, err, time.Since(start))
+	return res, err
+}
+
+// deliver does the Deliver job, returning the built message, or its head if streamed, for the logging as well
+func (em *Sender) deliver(ctx context.Context, text string, params Params) (*Result, []byte, error) {
+	// the breaker is checked first, so the open circuit fails fast without building the message
+	if err := em.allowSend(); err != nil {
+		return nil, nil, err
+	}
+	msg, err := em.prepareMessage(ctx, text, params)
+	if err != nil {
+		em.breaker.skip()
+		em.closeSMTPClient() // nothing started yet, but a client set with the SMTP option is closed on every failure
+		return nil, nil, withPhase(phasePrepare, err)
+	}
+	defer msg.close(em.logger)
+	res, err := em.deliverBuilt(ctx, msg, params, em.routeMessage)
+	return res, msg.head, err
+}
+
+// allowSend checks the circuit breaker before anything is done for the send, nothing is checked in dry run
+func (em *Sender) allowSend() error {
+	if em.dryRunMode {
+		return nil
+	}
+	if err := em.breaker.allow(em.timeNow(), em.logger); err != nil {
+		em.closeSMTPClient()
+		return withPhase(phaseCircuitBreaker, err)
+	}
+	return nil
+}
+
+// deliverBuilt sends the built message with send, or checks it in dry run, through the rate limit,
+// recording the outcome in the circuit breaker. Should be called after allowSend let the send through.
+func (em *Sender) deliverBuilt(ctx context.Context, msg *payload, params Params,
+	send func(context.Context, *payload, Params) (*Result, error)) (*Result, error) {
+	if em.dryRunMode {
+		em.closeSMTPClient()
+		return em.dryRun(msg, params)
+	}
+	if err := em.rateLimiter.wait(ctx, params.To, em.timeNow(), em.logger); err != nil {
+		em.breaker.skip()
+		em.closeSMTPClient()
+		return nil, withPhase(phaseRateLimit, err)
+	}
+	res, err := send(ctx, msg, params)
+	em.breaker.done(err, ctx.Err() != nil, em.timeNow(), em.logger)
+	return res, err
+}
+
+// sendThrough sends the message with send of the route transport or failover relay, applying the dry run,
+// circuit breaker and rate limit set for it, like the sender applies its own ones to the whole message
+func (em *Sender) sendThrough(ctx context.Context, msg *payload, params Params,
+	send func(context.Context, *payload, Params) (*Result, error)) (*Result, error) {
+	if err := em.allowSend(); err != nil {
+		return nil, err
+	}
+	return em.deliverBuilt(ctx, msg, params, send)
+}
+
+// prepareMessage checks what can be checked before the connection and builds the message,
+// or with Streaming its head, with all the files opened
+func (em *Sender) prepareMessage(ctx context.Context, text string, params Params) (*payload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	if len(params.To) == 0 {
-		return errors.New("no recipients")
+		return nil, errors.New("no recipients")
 	}
 
 	// message is built before the connection is made, this way a bad message doesn't reach the server at all
+	if em.streaming {
+		msg, err := em.openStream(text, params)
+		if err != nil {
+			return nil, fmt.Errorf("can't make email message: %w", err)
+		}
+		return msg, nil
+	}
 	msg, err := em.buildMessage(text, params)
 	if err != nil {
-		return fmt.Errorf("can't make email message: %w", err)
+		return nil, fmt.Errorf("can't make email message: %w", err)
+	}
+	return &payload{head: msg.Bytes(), size: wireSize(msg.Bytes())}, nil
+}
+
+// closeSMTPClient closes the client set with the SMTP option, if any
+func (em *Sender) closeSMTPClient() {
+	if em.smtpClient == nil {
+		return
 	}
+	if e := em.smtpClient.Close(); e != nil {
+		em.logger.Logf("[WARN] can't close smtp connection, %v", e)
+	}
+}
+
+// transfer sends the built message to the server in a single transaction, recording the transcript if set
+func (em *Sender) transfer(ctx context.Context, msg *payload, params Params) (*Result, error) {
+	rec := em.newTranscript()
+	res, err := em.transaction(ctx, msg, params, rec)
+	return res, em.reportTranscript(rec, err)
+}
 
-	if client == nil { // if client not set make new net/smtp
-		c, stop, e := em.client(ctx)
+// transaction sends the built message to the server, the connection is recorded to rec if not nil.
+// Always closes client on completion or failure.
+func (em *Sender) transaction(ctx context.Context, msg *payload, params Params, rec *transcript) (*Result, error) {
+	client := em.smtpClient // set by the SMTP option, nil when transfer makes its own client below
+
+	var quit bool
+	defer func() {
+		if quit || client == nil { // quit set if Quit() call passed because it's closing connection as well.
+			return
+		}
+		if e := client.Close(); e != nil {
+			em.logger.Logf("[WARN] can't close smtp connection, %v", e)
+		}
+	}()
+
+	if client == nil { // if client not set make new net/smtp, or LMTP client
+		c, stop, e := em.newClient(ctx, rec)
 		if e != nil {
-			return fmt.Errorf("failed to make smtp client: %w", e)
+			return nil, withPhase(phaseConnect, fmt.Errorf("failed to make smtp client: %w", &connectError{err: e}))
 		}
 		defer stop() // runs before the deferred close above, releasing the ctx watcher first
 		client = c
 	}
 
-	if auth := em.auth(); auth != nil {
-		if err = client.Auth(auth); err != nil {
-			return fmt.Errorf("failed to auth to smtp %s:%d, %w", em.host, em.port, err)
+	auth, err := em.auth(client)
+	auth = rec.authTLSState(auth)
+	if err != nil {
+		return nil, withPhase(phaseAuth, fmt.Errorf("failed to auth to smtp %s:%d, %w", em.host, em.port, err))
+	}
+	if auth != nil {
+		start := time.Now()
+		err = client.Auth(auth)
+		em.observe(ctx, PhaseAuth, start, err)
+		if err != nil {
+			return nil, withPhase(phaseAuth, fmt.Errorf("failed to auth to smtp %s:%d, %w", em.host, em.port, err))
 		}
 	}
 
-	if err = client.Mail(extractEmailAddress(params.From)); err != nil {
-		return fmt.Errorf("bad from address %q: %w", params.From, err)
+	if err = checkServerSize(client, msg.size); err != nil { // the server would reject it after the upload
+		return nil, withPhase(phaseMail, err)
+	}
+	smtputf8 := supportsSMTPUTF8(client)
+	from, err := envelopeAddress(extractEmailAddress(params.From), smtputf8)
+	if err != nil {
+		return nil, withPhase(phaseMail, fmt.Errorf("bad from address %q: %w", params.From, err))
+	}
+	start := time.Now()
+	err = mailFrom(client, from, msg.size)
+	em.observe(ctx, PhaseMail, start, err)
+	if err != nil {
+		return nil, withPhase(phaseMail, fmt.Errorf("bad from address %q: %w", params.From, err))
 	}
 
+	_, relay := em.serverAddress()
+	res := &Result{Relay: relay, Recipients: make([]RecipientStatus, 0, len(params.To))}
 	for _, rcpt := range params.To {
-		if err = client.Rcpt(extractEmailAddress(rcpt)); err != nil {
-			return fmt.Errorf("bad to address %q: %w", params.To, err)
+		addr, e := envelopeAddress(extractEmailAddress(rcpt), smtputf8)
+		if e != nil {
+			return nil, withPhase(phaseRcpt, fmt.Errorf("bad to address %q: %w", rcpt, e))
 		}
+		start = time.Now()
+		err = client.Rcpt(addr)
+		em.observe(ctx, PhaseRcpt, start, err)
+		if err != nil {
+			return nil, withPhase(phaseRcpt, fmt.Errorf("bad to address %q: %w", params.To, err))
+		}
+		res.Recipients = append(res.Recipients, RecipientStatus{Address: addr})
 	}
 
+	start = time.Now()
 	writer, err := client.Data()
 	if err != nil {
-		return fmt.Errorf("can't make email writer: %w", err)
+		em.observe(ctx, PhaseData, start, err)
+		return nil, withPhase(phaseData, fmt.Errorf("can't make email writer: %w", err))
 	}
 
-	if _, err = msg.WriteTo(writer); err != nil {
-		return fmt.Errorf("failed to send email body to %q: %w", params.To, err)
+	if err = em.writePayload(ctx, writer, msg); err != nil {
+		em.observe(ctx, PhaseData, start, err)
+		return nil, withPhase(phaseData, fmt.Errorf("failed to send email body to %q: %w", params.To, err))
 	}
 	// closing the writer reports the final response to the DATA command, i.e. the actual delivery result
-	if err = writer.Close(); err != nil {
-		return fmt.Errorf("failed to send email to %q: %w", params.To, err)
+	err = writer.Close()
+	em.observe(ctx, PhaseData, start, err)
+	if err != nil {
+		var rcptErr *RecipientsError
+		if errors.As(err, &rcptErr) { // some recipients got the message, the result tells which
+			res.Recipients = rcptErr.Recipients
+			return res, withPhase(phaseData, fmt.Errorf("failed to send email to %q: %w", params.To, err))
+		}
+		return nil, withPhase(phaseData, fmt.Errorf("failed to send email to %q: %w", params.To, err))
+	}
+	if lc, ok := client.(*lmtpClient); ok {
+		res.Recipients = lc.statuses
 	}
 
-	if err = client.Quit(); err != nil {
+	start = time.Now()
+	err = client.Quit()
+	em.observe(ctx, PhaseQuit, start, err)
+	if err != nil {
 		em.logger.Logf("[WARN] failed to send quit command to %s:%d, %v", em.host, em.port, err)
 	} else {
 		quit = true
 	}
-	return nil
+	return res, nil
 }
 
 // extractEmailAddress extracts the email address from a string that may contain a display name.
@@ -198,9 +441,9 @@ func extractEmailAddress(from string) string {
 }
 
 func (em *Sender) String() string {
-	return fmt.Sprintf("smtp://%s:%d, helo:%q, auth:%v, tls:%v, starttls:%v, insecureSkipVerify:%v, timeout:%v, content-type:%q, charset:%q",
-		em.host, em.port, em.effectiveHELOHost(), em.smtpUserName != "", em.tls, em.starttls, em.insecureSkipVerify,
-		em.timeOut, em.contentType, em.contentCharset)
+	return fmt.Sprintf("smtp://%s:%d, helo:%q, auth:%v, tls:%v, starttls:%v, insecureSkipVerify:%v, timeout:%v, content-type:%q, charset:%q, "+
+		"tls-policy:%s", em.host, em.port, em.effectiveHELOHost(), em.smtpUserName != "" || em.authMethod == authMethodExternal,
+		em.tls, em.starttls, em.insecureSkipVerify, em.timeOut, em.contentType, em.contentCharset, em.tlsPolicy())
 }
 
 func (em *Sender) effectiveHELOHost() string {
@@ -213,31 +456,39 @@ func (em *Sender) effectiveHELOHost() string {
 	return em.heloHost
 }
 
-// client makes smtp client with the connection bound to ctx: it is closed as soon as ctx is done,
-// which is the only way to interrupt net/smtp calls as they take no context.
-// Returned stop function releases that binding and has to be called when the client is not needed anymore.
-func (em *Sender) client(ctx context.Context) (c *smtp.Client, stop func(), err error) {
-	srvAddress := net.JoinHostPort(em.host, strconv.Itoa(em.port))
-	// #nosec G402
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: em.insecureSkipVerify, // #nosec G402
-		ServerName:         em.host,
-		MinVersion:         tls.VersionTLS12,
+// newClient makes LMTP client with LMTP option and smtp client otherwise, see client for the details
+func (em *Sender) newClient(ctx context.Context, rec *transcript) (SMTPClient, func(), error) {
+	if em.lmtp {
+		return em.lmtpClient(ctx, rec)
 	}
+	return em.client(ctx, rec)
+}
 
-	dialer := &net.Dialer{Timeout: em.timeOut}
+// serverAddress returns the network and the address of the server, the socket path with UnixSocket
+func (em *Sender) serverAddress() (network, address string) {
+	if em.unixSocket != "" {
+		return "unix", em.unixSocket
+	}
+	return "tcp", net.JoinHostPort(em.host, strconv.Itoa(em.port))
+}
 
-	var conn net.Conn
-	if em.tls {
-		if conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConf}).DialContext(ctx, "tcp", srvAddress); err != nil {
-			return nil, nil, fmt.Errorf("failed to dial smtp tls to %s: %w", srvAddress, err)
-		}
-	} else {
-		if conn, err = dialer.DialContext(ctx, "tcp", srvAddress); err != nil {
-			return nil, nil, fmt.Errorf("timeout connecting to %s: %w", srvAddress, err)
+// connect dials the server with the connection bound to ctx: it is closed as soon as ctx is done,
+// which is the only way to interrupt net/smtp calls as they take no context.
+// Returned stop function releases that binding and has to be called when the connection is not needed anymore.
+// Returned TLS config is the one for STARTTLS, nil if the policy never upgrades.
+// The connection is wrapped with the transcript recorder if rec is not nil.
+func (em *Sender) connect(ctx context.Context, rec *transcript) (conn net.Conn, tlsConf *tls.Config, stop func(), err error) {
+	network, srvAddress := em.serverAddress()
+	if em.tls || em.starttls != StartTLSNever {
+		if tlsConf, err = em.tlsConfig(); err != nil {
+			return nil, nil, nil, err
 		}
 	}
 
+	if conn, err = em.dial(ctx, network, srvAddress, tlsConf); err != nil {
+		return nil, nil, nil, err
+	}
+
 	// closing the connection is the only way to interrupt net/smtp calls, as they take no context
 	watchDone := make(chan struct{})
 	go func() {
@@ -255,6 +506,20 @@ func (em *Sender) client(ctx context.Context) (c *smtp.Client, stop func(), err
 			em.logger.Logf("[WARN] can't set deadline on smtp connection to %s, %v", srvAddress, e)
 		}
 	}
+	if rec != nil {
+		return newTranscriptConn(conn, rec), tlsConf, stop, nil
+	}
+	return conn, tlsConf, stop, nil
+}
+
+// client makes smtp client with the connection bound to ctx, see connect for the details.
+// The client is greeted and upgraded with STARTTLS as the policy says.
+func (em *Sender) client(ctx context.Context, rec *transcript) (c *smtp.Client, stop func(), err error) {
+	conn, tlsConf, stop, err := em.connect(ctx, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, srvAddress := em.serverAddress()
 
 	if c, err = smtp.NewClient(conn, em.host); err != nil {
 		stop()
@@ -274,12 +539,14 @@ func (em *Sender) client(ctx context.Context) (c *smtp.Client, stop func(), err
 		return nil, nil, err
 	}
 
-	if !em.tls && em.starttls {
-		if err = c.StartTLS(tlsConf); err != nil {
+	if !em.tls {
+		upgraded, e := em.startTLS(ctx, c, conn, tlsConf)
+		if e != nil {
 			stop()
 			_ = c.Close()
-			return nil, nil, fmt.Errorf("failed to start tls: %w", err)
+			return nil, nil, e
 		}
+		c = upgraded
 	}
 
 	return c, stop, nil
@@ -295,19 +562,6 @@ func (em *Sender) hello(client *smtp.Client) error {
 	return nil
 }
 
-// auth returns an smtp.Auth that implements SMTP authentication mechanism
-// depends on Sender settings.
-func (em *Sender) auth() smtp.Auth {
-	if em.smtpUserName == "" || em.smtpPassword == "" {
-		return nil // no auth
-	}
-
-	if em.authMethod == authMethodLogin {
-		return newLoginAuth(em.smtpUserName, em.smtpPassword, em.host)
-	}
-	return smtp.PlainAuth("", em.smtpUserName, em.smtpPassword, em.host)
-}
-
 // validateHeaders rejects user-provided values which would break out of the header they are put into.
 // CR and LF allow injecting arbitrary headers and message body, i.e. sending a different email than the caller intended.
 func (params Params) validateHeaders() error {
@@ -334,41 +588,116 @@ func (params Params) validateHeaders() error {
 			return err
 		}
 	}
+	for _, to := range params.originalTo {
+		if err := check("X-Original-To", to); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedHeaderNames(params.Headers) {
+		if err := checkHeaderName(name); err != nil {
+			return err
+		}
+		if err := check(name, params.Headers[name]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // buildMessage makes the complete message, headers and body, in a single buffer the caller sends as is
 func (em *Sender) buildMessage(text string, params Params) (*bytes.Buffer, error) {
+	head, err := em.buildHead(text, params)
+	if err != nil {
+		return nil, err
+	}
+	buff := head.data
+	if em.maxMessageSize > 0 || em.maxAttachmentSize > 0 { // checked before the files are encoded
+		if err = em.checkBuildLimits(head, params); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(params.InlineImages) > 0 {
+		buff.WriteString("\r\n\r\n")
+		if err := em.writeFiles(partsWriter(buff, head.boundaryRelated), params.InlineImages, "inline"); err != nil {
+			return nil, fmt.Errorf("failed to write inline images: %w", err)
+		}
+	}
+
+	if len(params.Attachments) > 0 {
+		buff.WriteString("\r\n\r\n")
+		if err := em.writeFiles(partsWriter(buff, head.boundaryMixed), params.Attachments, "attachment"); err != nil {
+			return nil, fmt.Errorf("failed to write attachments: %w", err)
+		}
+	}
+
+	return buff, nil
+}
+
+// messageHead is the beginning of the message, the headers and the text, followed by the file parts
+// with the boundaries picked for them
+type messageHead struct {
+	data            *bytes.Buffer
+	boundaryMixed   string
+	boundaryRelated string
+}
+
+// partsWriter returns the multipart writer of the file parts with the boundary picked for them in the head
+func partsWriter(w io.Writer, boundary string) *multipart.Writer {
+	mp := multipart.NewWriter(w)
+	_ = mp.SetBoundary(boundary) // made by multipart writer, always valid
+	return mp
+}
+
+// buildHead makes the headers and the text part of the message, the file parts are written after it
+func (em *Sender) buildHead(text string, params Params) (*messageHead, error) {
 	if err := params.validateHeaders(); err != nil {
 		return nil, err
 	}
 
 	buff := &bytes.Buffer{}
+	var headerErr error // the first header failed to fold, checked after all of them are added
 	addHeader := func(h, v string) {
-		fmt.Fprintf(buff, "%s: %s\n", h, v)
+		line, err := foldHeader(h, v)
+		if err != nil && headerErr == nil {
+			headerErr = err
+		}
+		buff.WriteString(line + "\n")
 	}
 
-	// body writers are made upfront because the boundaries they pick are needed in the headers,
-	// they write nothing until used, i.e. after all the headers are in the buffer
-	qp := quotedprintable.NewWriter(buff)
-	mpMixed := multipart.NewWriter(buff)
-	boundaryMixed := mpMixed.Boundary()
-	mpRelated := multipart.NewWriter(buff)
-	boundaryRelated := mpRelated.Boundary()
+	// boundaries are picked upfront because they are needed in the headers, the parts are written after the text
+	head := &messageHead{data: buff, boundaryMixed: multipart.NewWriter(nil).Boundary(),
+		boundaryRelated: multipart.NewWriter(nil).Boundary()}
 
-	addHeader("From", params.From)
-	addHeader("To", strings.Join(params.To, ","))
-	addHeader("Subject", mime.BEncoding.Encode("utf-8", params.Subject))
+	// addresses are checked here as well, so the message with a bad one doesn't reach the server
+	for _, h := range []struct {
+		name   string
+		values []string
+	}{{"From", []string{params.From}}, {"To", params.To}, {"X-Original-To", params.originalTo}} {
+		if len(h.values) == 0 {
+			continue
+		}
+		value, err := formatAddressList(h.name, h.values)
+		if err != nil {
+			return nil, err
+		}
+		addHeader(h.name, value)
+	}
+	addHeader("Subject", encodeText("Subject", params.Subject))
 
 	if params.UnsubscribeLink != "" {
 		addHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
-		addHeader("List-Unsubscribe", "<"+params.UnsubscribeLink+">")
+		addHeader("List-Unsubscribe", listHeaderURL("List-Unsubscribe", params.UnsubscribeLink))
 	}
 
 	if params.InReplyTo != "" {
 		addHeader("In-reply-to", "<"+params.InReplyTo+">")
 	}
 
+	for _, name := range sortedHeaderNames(params.Headers) {
+		addHeader(name, encodeText(name, params.Headers[name]))
+	}
+
 	withAttachments := len(params.Attachments) > 0
 	withInlineImg := len(params.InlineImages) > 0
 
@@ -377,43 +706,32 @@ func (em *Sender) buildMessage(text string, params Params) (*bytes.Buffer, error
 	}
 
 	addHeader("Date", em.timeNow().Format(time.RFC1123Z))
+	addHeader("Message-ID", "<"+em.randomID()+"@"+messageIDDomain(params.From)+">")
 
 	if withAttachments {
-		addHeader("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q\r\n\r\n%s\r",
-			boundaryMixed, "--"+boundaryMixed))
+		addHeader("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", head.boundaryMixed))
+		buff.WriteString("\r\n--" + head.boundaryMixed + "\r\n")
 	}
 
 	if withInlineImg {
-		addHeader("Content-Type", fmt.Sprintf("multipart/related; boundary=%q\r\n\r\n%s\r",
-			boundaryRelated, "--"+boundaryRelated))
+		addHeader("Content-Type", fmt.Sprintf("multipart/related; boundary=%q", head.boundaryRelated))
+		buff.WriteString("\r\n--" + head.boundaryRelated + "\r\n")
 	}
 
 	if em.contentType != "" {
 		addHeader("Content-Transfer-Encoding", "quoted-printable")
 		addHeader("Content-Type", fmt.Sprintf("%s; charset=%q", em.contentType, em.contentCharset))
 	}
+	if headerErr != nil {
+		return nil, headerErr
+	}
 
 	buff.WriteString("\n") // empty line between the headers and the body
 
-	if err := em.writeBody(qp, text); err != nil {
+	if err := em.writeBody(quotedprintable.NewWriter(buff), text); err != nil {
 		return nil, fmt.Errorf("failed to write body: %w", err)
 	}
-
-	if withInlineImg {
-		buff.WriteString("\r\n\r\n")
-		if err := em.writeFiles(mpRelated, params.InlineImages, "inline"); err != nil {
-			return nil, fmt.Errorf("failed to write inline images: %w", err)
-		}
-	}
-
-	if withAttachments {
-		buff.WriteString("\r\n\r\n")
-		if err := em.writeFiles(mpMixed, params.Attachments, "attachment"); err != nil {
-			return nil, fmt.Errorf("failed to write attachments: %w", err)
-		}
-	}
-
-	return buff, nil
+	return head, nil
 }
 
 func (em *Sender) writeBody(wc io.WriteCloser, text string) error {
@@ -440,6 +758,9 @@ func (em *Sender) writeFiles(mp *multipart.Writer, files []string, disposition s
 
 // writeFile adds a single file as a mime part, the file is closed on every return path
 func (em *Sender) writeFile(mp *multipart.Writer, attachment, disposition string) (err error) {
+	if _, err = attachmentName(attachment); err != nil {
+		return err
+	}
 	file, err := os.Open(filepath.Clean(attachment))
 	if err != nil {
 		return err
@@ -449,39 +770,24 @@ func (em *Sender) writeFile(mp *multipart.Writer, attachment, disposition string
 			err = e
 		}
 	}()
+	return em.writeFilePart(mp, file, disposition)
+}
 
-	// we need first 512 bytes to detect file type, an empty file is fine and detected as plain text
-	fTypeBuff := make([]byte, 512)
-	n, err := file.Read(fTypeBuff)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("failed to read file type %q: %w", attachment, err)
-	}
-	fTypeBuff = fTypeBuff[:n] // file can be shorter than the buffer
-
+// attachmentName returns the file name the part of the file gets
+func attachmentName(attachment string) (string, error) {
 	fName := filepath.Base(attachment)
 	// CR and LF are legal in file names but would terminate the header the name goes into
 	if strings.ContainsAny(fName, "\r\n") {
-		return fmt.Errorf("invalid file name %q: contains CR or LF", attachment)
-	}
-
-	// the detected type is always parseable, it comes from a fixed set of sniffed types
-	contentType, ctParams, _ := mime.ParseMediaType(http.DetectContentType(fTypeBuff))
-	params := map[string]string{"name": fName}
-	for k, v := range ctParams { // carries the charset of the text types over
-		params[k] = v
+		return "", fmt.Errorf("invalid file name %q: contains CR or LF", attachment)
 	}
+	return fName, nil
+}
 
-	// mime formatting quotes and encodes the file name, plain interpolation would let it break out of the header
-	header := textproto.MIMEHeader{}
-	header.Set("Content-Type", mime.FormatMediaType(contentType, params))
-	header.Set("Content-Transfer-Encoding", "base64")
-
-	switch disposition {
-	case "attachment", "inline":
-		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fName}))
-	}
-	if disposition == "inline" {
-		header.Set("Content-ID", fmt.Sprintf("<%s>", fName))
+// writeFilePart adds the open file as a mime part, read from the beginning
+func (em *Sender) writeFilePart(mp *multipart.Writer, file *os.File, disposition string) error {
+	header, err := filePartHeader(file, disposition)
+	if err != nil {
+		return err
 	}
 
 	writer, err := mp.CreatePart(header)
@@ -489,7 +795,7 @@ func (em *Sender) writeFile(mp *multipart.Writer, attachment, disposition string
 		return err
 	}
 
-	// set reader offset at the beginning of the file because we read first 512 bytes
+	// read from the beginning, the file can be written more than once, e.g. to failover relays
 	if _, err = file.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
@@ -501,6 +807,49 @@ func (em *Sender) writeFile(mp *multipart.Writer, attachment, disposition string
 	return encoder.Close()
 }
 
+// filePartHeader makes the mime header of the file part, with the content type detected from the file
+func filePartHeader(file *os.File, disposition string) (textproto.MIMEHeader, error) {
+	fName, err := attachmentName(file.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	// we need first 512 bytes to detect file type, an empty file is fine and detected as plain text
+	fTypeBuff := make([]byte, 512)
+	n, err := file.ReadAt(fTypeBuff, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read file type %q: %w", file.Name(), err)
+	}
+	fTypeBuff = fTypeBuff[:n] // file can be shorter than the buffer
+
+	// the detected type is always parseable, it comes from a fixed set of sniffed types
+	contentType, ctParams, _ := mime.ParseMediaType(http.DetectContentType(fTypeBuff))
+	params := map[string]string{"name": fName}
+	for k, v := range ctParams { // carries the charset of the text types over
+		params[k] = v
+	}
+
+	// mime formatting quotes and encodes the file name, plain interpolation would let it break out of the header
+	values := [][2]string{{"Content-Type", formatMediaType(contentType, params)}, {"Content-Transfer-Encoding", "base64"}}
+	switch disposition {
+	case "attachment", "inline":
+		values = append(values, [2]string{"Content-Disposition", formatMediaType(disposition, map[string]string{"filename": fName})})
+	}
+	if disposition == "inline" {
+		values = append(values, [2]string{"Content-ID", fmt.Sprintf("<%s>", fName)})
+	}
+
+	header := textproto.MIMEHeader{}
+	for _, v := range values {
+		value, err := partHeaderValue(v[0], v[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid file name %q: %w", file.Name(), err)
+		}
+		header.Set(v[0], value)
+	}
+	return header, nil
+}
+
 // base64LineLimit is the maximum line length for base64 encoded mime parts, set by RFC 2045
 const base64LineLimit = 76
 
@@ -57,7 +57,7 @@ func TestEmail_New(t *testing.T) {
 	assert.Equal(t, "blah", s.contentCharset)
 	assert.Empty(t, s.heloHost)
 	assert.True(t, s.tls)
-	assert.True(t, s.starttls)
+	assert.Equal(t, StartTLSRequired, s.starttls)
 }
 
 func TestEmail_NewHELOHost(t *testing.T) {
@@ -126,7 +126,7 @@ func TestEmail_ClientHELOHost(t *testing.T) {
 				return expectSMTPQuit(conn, reader)
 			})
 
-			client, _, err := tt.sender(host, port).client(context.Background())
+			client, _, err := tt.sender(host, port).client(context.Background(), nil)
 			require.NoError(t, err)
 			require.NoError(t, client.Quit())
 			waitSMTPTestServer(t, done)
@@ -164,7 +164,7 @@ func TestEmail_ClientWithoutHELOHostGreetsLocalhost(t *testing.T) {
 		return expectSMTPQuit(conn, reader)
 	})
 
-	client, _, err := NewSender(host, Port(port)).client(context.Background())
+	client, _, err := NewSender(host, Port(port)).client(context.Background(), nil)
 	require.NoError(t, err)
 	require.NoError(t, client.Mail("sender@example.com"))
 	require.NoError(t, client.Quit())
@@ -201,7 +201,7 @@ func TestEmail_ClientHELOFallback(t *testing.T) {
 	})
 
 	sender := NewSender(host, Port(port), HELOHost("client.example.net"))
-	client, _, err := sender.client(context.Background())
+	client, _, err := sender.client(context.Background(), nil)
 	require.NoError(t, err)
 	require.NoError(t, client.Quit())
 	waitSMTPTestServer(t, done)
@@ -229,7 +229,7 @@ func TestEmail_ClientHELOFailureClosesConnection(t *testing.T) {
 	})
 
 	sender := NewSender(host, Port(port), HELOHost("client.example.net"))
-	client, _, err := sender.client(context.Background())
+	client, _, err := sender.client(context.Background(), nil)
 	require.Error(t, err)
 	assert.Nil(t, client)
 	assert.Contains(t, err.Error(), "failed to send SMTP greeting")
@@ -268,7 +268,7 @@ func TestEmail_ClientSTARTTLSFailureClosesConnection(t *testing.T) {
 	})
 
 	sender := NewSender(host, Port(port), STARTTLS(true), HELOHost("client.example.net"))
-	client, _, err := sender.client(context.Background())
+	client, _, err := sender.client(context.Background(), nil)
 	require.Error(t, err)
 	assert.Nil(t, client)
 	assert.Contains(t, err.Error(), "failed to start tls")
@@ -363,7 +363,7 @@ func TestEmail_ClientSTARTTLSReusesHELOHost(t *testing.T) {
 	})
 
 	sender := NewSender(host, Port(port), STARTTLS(true), InsecureSkipVerify(true), HELOHost("client.example.net"))
-	client, _, err := sender.client(context.Background())
+	client, _, err := sender.client(context.Background(), nil)
 	require.NoError(t, err)
 	require.NoError(t, client.Quit())
 	waitSMTPTestServer(t, done)
@@ -394,7 +394,7 @@ func TestEmail_ClientTLSHELOHost(t *testing.T) {
 	})
 
 	sender := NewSender(host, Port(port), TLS(true), InsecureSkipVerify(true), HELOHost("client.example.net"))
-	client, _, err := sender.client(context.Background())
+	client, _, err := sender.client(context.Background(), nil)
 	require.NoError(t, err)
 	require.NoError(t, client.Quit())
 	waitSMTPTestServer(t, done)
@@ -415,6 +415,7 @@ func TestEmail_Send(t *testing.T) {
 		Auth("user", "pass"), TimeOut(time.Second), HELOHost("ignored.example.net"))
 
 	s.timeNow = func() time.Time { return time.Date(2022, time.February, 10, 23, 33, 58, 0, time.UTC) }
+	s.randomID = func() string { return "0123456789abcdef" }
 
 	err := s.Send("some text\n", Params{
 		From:    "from@example.com",
@@ -423,7 +424,7 @@ func TestEmail_Send(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	expBody := "From: from@example.com\nTo: to@example.com\nSubject: subj\nMIME-version: 1.0\nDate: Thu, 10 Feb 2022 23:33:58 +0000\nContent-Transfer-Encoding: quoted-printable\nContent-Type: text/html; charset=\"UTF-8\"\n\nsome text\r\n"
+	expBody := "From: from@example.com\nTo: to@example.com\nSubject: subj\nMIME-version: 1.0\nDate: Thu, 10 Feb 2022 23:33:58 +0000\nMessage-ID: <0123456789abcdef@example.com>\nContent-Transfer-Encoding: quoted-printable\nContent-Type: text/html; charset=\"UTF-8\"\n\nsome text\r\n"
 	assert.Equal(t, expBody, wc.buff.String())
 
 	require.Len(t, smtpClient.MailCalls(), 1)
@@ -439,6 +440,30 @@ func TestEmail_Send(t *testing.T) {
 	assert.Empty(t, smtpClient.CloseCalls(), "not called because quit is called")
 }
 
+func TestEmail_Deliver(t *testing.T) {
+	wc := &fakeWriterCloser{buff: bytes.NewBuffer(nil)}
+	smtpClient := &mocks.SMTPClientMock{
+		CloseFunc: func() error { return nil },
+		MailFunc:  func(string) error { return nil },
+		QuitFunc:  func() error { return nil },
+		RcptFunc:  func(_ string) error { return nil },
+		DataFunc:  func() (io.WriteCloser, error) { return wc, nil },
+	}
+
+	s := NewSender("localhost", SMTP(smtpClient))
+	res, err := s.Deliver(context.Background(), "some text\n", Params{
+		From: "from@example.com",
+		To:   []string{"to@example.com", `"Two" <to2@example.com>`},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &Result{Relay: "localhost:25", Recipients: []RecipientStatus{{Address: "to@example.com"}, {Address: "to2@example.com"}}}, res,
+		"smtp server has no per-recipient replies")
+
+	res, err = s.Deliver(context.Background(), "some text\n", Params{From: "from@example.com"})
+	require.EqualError(t, err, "no recipients")
+	assert.Nil(t, res)
+}
+
 func TestEmail_SendWithDisplayName(t *testing.T) {
 	wc := &fakeWriterCloser{buff: bytes.NewBuffer(nil)}
 	smtpClient := &mocks.SMTPClientMock{
@@ -454,6 +479,7 @@ func TestEmail_SendWithDisplayName(t *testing.T) {
 		Auth("user", "pass"), TimeOut(time.Second))
 
 	s.timeNow = func() time.Time { return time.Date(2022, time.February, 10, 23, 33, 58, 0, time.UTC) }
+	s.randomID = func() string { return "0123456789abcdef" }
 
 	err := s.Send("some text\n", Params{
 		From:    `"John Doe" <john@example.com>`,
@@ -462,14 +488,15 @@ func TestEmail_SendWithDisplayName(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	expBody := "From: \"John Doe\" <john@example.com>\nTo: to@example.com\nSubject: subj\nMIME-version: 1.0\nDate: Thu, 10 Feb 2022 23:33:58 +0000\nContent-Transfer-Encoding: quoted-printable\nContent-Type: text/html; charset=\"UTF-8\"\n\nsome text\r\n"
+	expBody := "From: \"John Doe\" <john@example.com>\nTo: to@example.com\nSubject: subj\nMIME-version: 1.0\nDate: Thu, 10 Feb 2022 23:33:58 +0000\nMessage-ID: <0123456789abcdef@example.com>\nContent-Transfer-Encoding: quoted-printable\nContent-Type: text/html; charset=\"UTF-8\"\n\nsome text\r\n"
 	assert.Equal(t, expBody, wc.buff.String())
 	assert.Equal(t, "john@example.com", smtpClient.MailCalls()[0].From)
 }
 
 func TestEmail_LoginAuth(t *testing.T) {
 	s := NewSender("localhost", Auth("user", "pass"), LoginAuth())
-	auth := s.auth()
+	auth, err := s.auth(nil)
+	require.NoError(t, err)
 	proto, _, err := auth.Start(&smtp.ServerInfo{Name: "localhost"})
 
 	require.NoError(t, err)
@@ -733,6 +760,24 @@ func TestEmail_SendHeaderInjection(t *testing.T) {
 				InReplyTo: "uuid@example.com>\nBcc: attacker@example.net"},
 			expErr: "invalid In-reply-to header value",
 		},
+		{
+			name: "CRLF in extra header",
+			params: Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj",
+				Headers: map[string]string{"X-Campaign": "spring\r\nBcc: attacker@example.net"}},
+			expErr: "invalid X-Campaign header value",
+		},
+		{
+			name: "CRLF in extra header name",
+			params: Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj",
+				Headers: map[string]string{"Bcc: attacker@example.net\r\nX-Campaign": "spring"}},
+			expErr: "invalid header name",
+		},
+		{
+			name: "extra header overriding the generated one",
+			params: Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj",
+				Headers: map[string]string{"content-type": "text/plain"}},
+			expErr: `invalid header name "content-type": set by the sender`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -1169,16 +1214,17 @@ func TestWriteBodyFail(t *testing.T) {
 
 func TestSender_String(t *testing.T) {
 	e := NewSender("localhost", ContentType("text/html"), Port(2525), Auth("user", "pass"))
-	assert.Equal(t, `smtp://localhost:2525, helo:"localhost", auth:true, tls:false, starttls:false, insecureSkipVerify:false, timeout:30s, content-type:"text/html", charset:"UTF-8"`,
+	assert.Equal(t, `smtp://localhost:2525, helo:"localhost", auth:true, tls:false, starttls:never, insecureSkipVerify:false, timeout:30s, content-type:"text/html", charset:"UTF-8", tls-policy:none`,
 		e.String())
 
 	e = NewSender("localhost", ContentType("text/html"), Port(2525), TLS(true), STARTTLS(true), InsecureSkipVerify(true),
 		TimeOut(10*time.Second), HELOHost("client.example.net"))
-	assert.Equal(t, `smtp://localhost:2525, helo:"client.example.net", auth:false, tls:true, starttls:true, insecureSkipVerify:true, timeout:10s, content-type:"text/html", charset:"UTF-8"`,
+	assert.Equal(t, `smtp://localhost:2525, helo:"client.example.net", auth:false, tls:true, starttls:required, insecureSkipVerify:true, timeout:10s, content-type:"text/html", charset:"UTF-8", `+
+		`tls-policy:{min:TLS1.2, verify:skipped, server-name:"localhost", client-cert:none, pins:0, ciphers:default}`,
 		e.String())
 
 	e = NewSender("localhost", SMTP(&mocks.SMTPClientMock{}))
-	assert.Equal(t, `smtp://localhost:25, helo:"client-managed", auth:false, tls:false, starttls:false, insecureSkipVerify:false, timeout:30s, content-type:"text/plain", charset:"UTF-8"`, e.String())
+	assert.Equal(t, `smtp://localhost:25, helo:"client-managed", auth:false, tls:false, starttls:never, insecureSkipVerify:false, timeout:30s, content-type:"text/plain", charset:"UTF-8", tls-policy:none`, e.String())
 }
 
 // uncomment to debug with real smtp server
@@ -1211,6 +1257,32 @@ func (wc *fakeWriterCloser) Close() error {
 	return wc.closeErr
 }
 
+// newTestSMTPClient makes a mock client accepting everything, with the message data discarded
+func newTestSMTPClient() *mocks.SMTPClientMock {
+	return &mocks.SMTPClientMock{
+		AuthFunc:  func(smtp.Auth) error { return nil },
+		CloseFunc: func() error { return nil },
+		MailFunc:  func(string) error { return nil },
+		QuitFunc:  func() error { return nil },
+		RcptFunc:  func(string) error { return nil },
+		DataFunc:  func() (io.WriteCloser, error) { return &fakeWriterCloser{buff: bytes.NewBuffer(nil)}, nil },
+	}
+}
+
+// newTestRelay makes a sender with a mock client failing MAIL with mailErr
+func newTestRelay(host string, mailErr error) (*Sender, *mocks.SMTPClientMock) {
+	client := newTestSMTPClient()
+	client.MailFunc = func(string) error { return mailErr }
+	return NewSender(host, SMTP(client)), client
+}
+
+// newTestLogger makes a mock logger writing the lines to buff
+func newTestLogger(buff *bytes.Buffer) *mocks.LoggerMock {
+	return &mocks.LoggerMock{LogfFunc: func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(buff, format+"\n", args...)
+	}}
+}
+
 func startSMTPTestServer(t *testing.T, handler func(net.Conn) error) (host string, port int, done <-chan error) {
 	t.Helper()
 
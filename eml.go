@@ -0,0 +1,209 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ParsedMessage is the RFC 5322 message read back by ParseMessage, the reverse of the message Send makes
+type ParsedMessage struct {
+	Header      mail.Header     // all the headers, as in the message
+	From        []*mail.Address // display names decoded
+	To          []*mail.Address
+	Cc          []*mail.Address
+	Subject     string    // decoded
+	Date        time.Time // zero if the message has no valid Date header
+	Text        string    // text/plain body decoded to UTF-8, the first one if there are several
+	HTML        string    // text/html body decoded to UTF-8, the first one if there are several
+	Inline      []Part    // inline parts referenced by their content ID, like embedded images
+	Attachments []Part
+}
+
+// Part is the attachment or inline part of the message
+type Part struct {
+	FileName    string
+	ContentType string // media type, without parameters
+	ContentID   string // without angle brackets, empty for attachments usually
+	Data        []byte // decoded from the transfer encoding
+}
+
+// headerDecoder decodes RFC 2047 encoded words in the charsets decodeCharset supports
+var headerDecoder = &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeCharset(charset, data)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}}
+
+// ParseMessage reads RFC 5322 message: the headers with RFC 2047 encoded words decoded, text and HTML bodies decoded
+// from quoted-printable or base64 and the declared charset, inline parts with their content IDs, and attachments.
+// Supported charsets are UTF-8, US-ASCII, ISO-8859-1 and Windows-1252, others fail the parse.
+func ParseMessage(r io.Reader) (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("can't read message: %w", err)
+	}
+
+	res := &ParsedMessage{Header: msg.Header}
+	if res.Subject, err = headerDecoder.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		return nil, fmt.Errorf("can't decode subject: %w", err)
+	}
+	res.Date, _ = msg.Header.Date() // missing or malformed date is left zero, the header is still there
+	addrParser := &mail.AddressParser{WordDecoder: headerDecoder}
+	for _, h := range []struct {
+		name string
+		list *[]*mail.Address
+	}{{"From", &res.From}, {"To", &res.To}, {"Cc", &res.Cc}} {
+		if msg.Header.Get(h.name) == "" {
+			continue
+		}
+		if *h.list, err = addrParser.ParseList(msg.Header.Get(h.name)); err != nil {
+			return nil, fmt.Errorf("can't parse %s header: %w", h.name, err)
+		}
+	}
+
+	if err = res.readPart(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readPart reads the part with the header, going into the nested parts of multipart ones
+func (m *ParsedMessage) readPart(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{} // RFC 2045 default, also for the missing header
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, e := mr.NextRawPart() // raw, as NextPart hides the quoted-printable encoding header
+			if errors.Is(e, io.EOF) {
+				return nil
+			}
+			if e != nil {
+				return fmt.Errorf("can't read %s part: %w", mediaType, e)
+			}
+			if e = m.readPart(p.Header, p); e != nil {
+				return e
+			}
+		}
+	}
+
+	data, err := io.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("can't decode %s part: %w", mediaType, err)
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	contentID := strings.Trim(header.Get("Content-ID"), "<>")
+	isBody := disposition != "attachment" && (mediaType == "text/plain" && m.Text == "" || mediaType == "text/html" && m.HTML == "")
+	if isBody && contentID == "" {
+		text, e := decodeCharset(params["charset"], data)
+		if e != nil {
+			return fmt.Errorf("can't decode %s body: %w", mediaType, e)
+		}
+		if mediaType == "text/html" {
+			m.HTML = text
+			return nil
+		}
+		m.Text = text
+		return nil
+	}
+
+	fileName := dispParams["filename"]
+	if fileName == "" {
+		fileName = params["name"]
+	}
+	if decoded, e := headerDecoder.DecodeHeader(fileName); e == nil { // RFC 2047 encoded names are common
+		fileName = decoded
+	}
+	part := Part{FileName: fileName, ContentType: mediaType, ContentID: contentID, Data: data}
+	if disposition == "inline" || disposition == "" && contentID != "" {
+		m.Inline = append(m.Inline, part)
+		return nil
+	}
+	m.Attachments = append(m.Attachments, part)
+	return nil
+}
+
+// transferDecoder returns the reader decoding the content transfer encoding
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	}
+	return r
+}
+
+// base64Cleaner drops the line breaks and spaces, base64 decoder only skips CR and LF
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	clean := p[:0]
+	for _, b := range p[:n] {
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			clean = append(clean, b)
+		}
+	}
+	return len(clean), err
+}
+
+// windows1252 maps bytes 0x80-0x9F of Windows-1252, the rest of them is the same as in ISO-8859-1
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// decodeCharset converts the text in the charset to UTF-8, empty charset is US-ASCII
+func decodeCharset(charset string, data []byte) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(data), nil
+	case "iso-8859-1", "latin1", "iso_8859-1":
+		return decodeSingleByte(data, nil), nil
+	case "windows-1252", "cp1252":
+		return decodeSingleByte(data, &windows1252), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+// decodeSingleByte converts ISO-8859-1 text, with the bytes 0x80-0x9F mapped by the table if given
+func decodeSingleByte(data []byte, table *[32]rune) string {
+	buff := bytes.NewBuffer(make([]byte, 0, len(data)+len(data)/2))
+	for _, b := range data {
+		r := rune(b)
+		if table != nil && b >= 0x80 && b < 0xA0 {
+			r = table[b-0x80]
+		}
+		if r < utf8.RuneSelf {
+			buff.WriteByte(byte(r))
+			continue
+		}
+		buff.WriteRune(r)
+	}
+	return buff.String()
+}
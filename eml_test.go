@@ -0,0 +1,133 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files of the tests")
+
+func TestParseMessage_Golden(t *testing.T) {
+	files, err := filepath.Glob("testdata/eml/*.eml")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			fh, err := os.Open(file) //nolint:gosec // test data
+			require.NoError(t, err)
+			defer fh.Close()
+			msg, err := ParseMessage(fh)
+			require.NoError(t, err)
+
+			msg.Header = nil // the raw headers are in the file already
+			got, err := json.MarshalIndent(msg, "", "  ")
+			require.NoError(t, err)
+			golden := strings.TrimSuffix(file, ".eml") + ".golden"
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, append(got, '\n'), 0o600))
+			}
+			expected, err := os.ReadFile(golden) //nolint:gosec // test data
+			require.NoError(t, err)
+			assert.Equal(t, string(expected), string(got)+"\n")
+		})
+	}
+}
+
+func TestParseMessage_Decoding(t *testing.T) {
+	fh, err := os.Open("testdata/eml/alternative.eml")
+	require.NoError(t, err)
+	defer fh.Close()
+	msg, err := ParseMessage(fh)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Café ☕ menu", msg.Subject)
+	require.Len(t, msg.From, 1)
+	assert.Equal(t, "Jürgen Müller", msg.From[0].Name)
+	require.Len(t, msg.Cc, 1)
+	assert.Equal(t, "René", msg.Cc[0].Name)
+	assert.Equal(t, []string{"bob@example.com", "alice@example.com"}, []string{msg.To[0].Address, msg.To[1].Address})
+	assert.Equal(t, "Prix: 5 EUR, café, a long line which is soft broken", msg.Text)
+	assert.Equal(t, "<p>Prix: 5 €, café</p>", msg.HTML)
+	assert.Equal(t, time.Date(2022, time.February, 10, 22, 33, 58, 0, time.UTC), msg.Date.UTC())
+}
+
+func TestParseMessage_RoundTrip(t *testing.T) {
+	s := NewSender("localhost", ContentType("text/html"))
+	s.timeNow = func() time.Time { return time.Date(2022, time.February, 10, 23, 33, 58, 0, time.UTC) }
+	params := Params{From: `"John Doe" <john@example.com>`, To: []string{"to@example.com", "Two <two@example.com>"},
+		Subject: "Résumé of the 日本語 meeting", Attachments: []string{"testdata/1.txt", "testdata/2.txt"},
+		InlineImages: []string{"testdata/image.jpg"}}
+	body := "<p>line one, café</p>\n<img src=\"cid:image.jpg\">\n" + strings.Repeat("long line ", 20)
+
+	built, err := s.BuildMessage(body, params)
+	require.NoError(t, err)
+	msg, err := ParseMessage(built.Reader())
+	require.NoError(t, err)
+
+	assert.Equal(t, params.Subject, msg.Subject)
+	require.Len(t, msg.From, 1)
+	assert.Equal(t, "John Doe", msg.From[0].Name)
+	assert.Equal(t, "john@example.com", msg.From[0].Address)
+	require.Len(t, msg.To, 2)
+	assert.Equal(t, "two@example.com", msg.To[1].Address)
+	assert.Equal(t, s.timeNow(), msg.Date.UTC())
+	assert.Equal(t, strings.ReplaceAll(body, "\n", "\r\n")+"\r\n", msg.HTML, "with the blank line before the parts")
+	assert.Empty(t, msg.Text)
+
+	image, err := os.ReadFile("testdata/image.jpg")
+	require.NoError(t, err)
+	require.Len(t, msg.Inline, 1)
+	assert.Equal(t, Part{FileName: "image.jpg", ContentType: "image/jpeg", ContentID: "image.jpg", Data: image}, msg.Inline[0])
+
+	require.Len(t, msg.Attachments, 2)
+	for i, file := range params.Attachments {
+		data, err := os.ReadFile(file) //nolint:gosec // test data
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Base(file), msg.Attachments[i].FileName)
+		assert.Equal(t, data, msg.Attachments[i].Data)
+	}
+}
+
+func TestParseMessage_Errors(t *testing.T) {
+	tbl := []struct {
+		name, raw, err string
+	}{
+		{"no headers", "", "can't read message"},
+		{"bad address", "From: <broken\r\n\r\nbody", "can't parse From header"},
+		{"unsupported charset", "Content-Type: text/plain; charset=koi8-r\r\n\r\nbody", `unsupported charset "koi8-r"`},
+		{"bad multipart", "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nbroken header\r\n\r\n--b--\r\n",
+			"can't read multipart/mixed part"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseMessage(strings.NewReader(tt.raw))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	text, err := decodeCharset("ISO-8859-1", []byte("caf\xe9 \x80"))
+	require.NoError(t, err)
+	assert.Equal(t, "café \u0080", text)
+
+	text, err = decodeCharset("windows-1252", []byte("\x93q\x94 \x80 \xe9"))
+	require.NoError(t, err)
+	assert.Equal(t, "“q” € é", text)
+
+	text, err = decodeCharset("", []byte("plain"))
+	require.NoError(t, err)
+	assert.Equal(t, "plain", text)
+	assert.True(t, bytes.Equal([]byte("plain"), []byte(text)))
+}
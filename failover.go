@@ -0,0 +1,123 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// connectError is the failure to connect, greet or start TLS, i.e. anything before the transaction itself
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string { return e.err.Error() }
+
+func (e *connectError) Unwrap() error { return e.err }
+
+// relayState keeps the failed relays with the time they are skipped until, shared by the sends of the sender
+type relayState struct {
+	mu          sync.Mutex
+	failedUntil map[*Sender]time.Time
+}
+
+// deliverMessage sends the built message through the sender's own server, and with Failover set through the relays
+// in order, the next one tried on a connection failure or 4xx reply of the previous.
+// A relay failed this way is skipped for the cool-down time, unless all the others failed as well.
+func (em *Sender) deliverMessage(ctx context.Context, msg *payload, params Params) (*Result, error) {
+	if em.mxResolver != nil {
+		return em.deliverMX(ctx, msg, params)
+	}
+	if len(em.relays) == 0 {
+		return em.transfer(ctx, msg, params)
+	}
+
+	var lastErr error
+	relays := em.relayOrder()
+	for _, relay := range relays {
+		_, addr := relay.serverAddress()
+		res, err := em.transferRelay(ctx, relay, msg, params)
+		if err == nil {
+			em.relayState.markDelivered(relay)
+			em.logger.Logf("[INFO] email to %v delivered through relay %s", params.To, addr)
+			return res, nil
+		}
+		if ctx.Err() == nil && notTried(err) { // relay's own breaker or rate limit, the next one may take it
+			em.logger.Logf("[WARN] relay %s skipped, %v", addr, err)
+			lastErr = err
+			continue
+		}
+		if ctx.Err() != nil || !temporaryFailure(err) {
+			return res, err // permanent rejection is the same for all relays, and nothing more is allowed with ctx done
+		}
+		em.relayState.markFailed(relay, em.timeNow().Add(em.relayCoolDown))
+		em.logger.Logf("[WARN] relay %s failed, %v", addr, err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("all %d relays failed, last error: %w", len(relays), lastErr)
+}
+
+// transferRelay sends the message through the relay, with its own dry run, circuit breaker and rate limit.
+// The sender itself has them applied already.
+func (em *Sender) transferRelay(ctx context.Context, relay *Sender, msg *payload, params Params) (*Result, error) {
+	if relay == em {
+		return em.transfer(ctx, msg, params)
+	}
+	return relay.sendThrough(ctx, msg, params, relay.transfer)
+}
+
+// notTried tells if the send was refused by the circuit breaker or rate limit of a route transport
+// or failover relay, so the error says nothing about the server
+func notTried(err error) bool {
+	var openErr *CircuitOpenError
+	var limitErr *RateLimitError
+	return errors.As(err, &openErr) || errors.As(err, &limitErr)
+}
+
+// relayOrder returns the sender itself followed by the relays, with the ones in cool-down moved to the end
+func (em *Sender) relayOrder() []*Sender {
+	now := em.timeNow()
+	active := make([]*Sender, 0, len(em.relays)+1)
+	var coolingDown []*Sender
+	for _, relay := range append([]*Sender{em}, em.relays...) {
+		if em.relayState.coolingDown(relay, now) {
+			coolingDown = append(coolingDown, relay)
+			continue
+		}
+		active = append(active, relay)
+	}
+	return append(active, coolingDown...)
+}
+
+func (s *relayState) coolingDown(relay *Sender, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.failedUntil[relay]
+	return ok && now.Before(until)
+}
+
+func (s *relayState) markFailed(relay *Sender, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedUntil[relay] = until
+}
+
+func (s *relayState) markDelivered(relay *Sender) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failedUntil, relay)
+}
+
+// temporaryFailure tells if another relay may succeed where this one failed: it couldn't be connected to,
+// or it replied with 4xx. 5xx reply rejects the message itself and goes back to the caller.
+func temporaryFailure(err error) bool {
+	var connErr *connectError
+	if errors.As(err, &connErr) {
+		return true
+	}
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 400 && protoErr.Code < 500
+}
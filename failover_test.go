@@ -0,0 +1,134 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_DeliverFailover(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}
+	unreachable := DialContext(func(context.Context, string, string) (net.Conn, error) { return nil, errors.New("connection refused") })
+
+	t.Run("connection failure", func(t *testing.T) {
+		relay, relayClient := newTestRelay("relay.example.com", nil)
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("primary.example.com", unreachable, Failover(time.Minute, relay), Log(newTestLogger(logBuff)))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, "relay.example.com:25", res.Relay)
+		assert.Equal(t, []RecipientStatus{{Address: "to@example.com"}}, res.Recipients)
+		assert.Len(t, relayClient.DataCalls(), 1)
+		assert.Contains(t, logBuff.String(), "[WARN] relay primary.example.com:25 failed, failed to make smtp client")
+		assert.Contains(t, logBuff.String(), "[INFO] email to [to@example.com] delivered through relay relay.example.com:25")
+	})
+
+	t.Run("4xx reply", func(t *testing.T) {
+		primary, primaryClient := newTestRelay("primary.example.com", &textproto.Error{Code: 451, Msg: "try again later"})
+		relay, relayClient := newTestRelay("relay.example.com", nil)
+		primary.relays, primary.relayState = []*Sender{relay}, &relayState{failedUntil: map[*Sender]time.Time{}}
+
+		res, err := primary.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, "relay.example.com:25", res.Relay)
+		assert.Len(t, primaryClient.MailCalls(), 1)
+		assert.Len(t, primaryClient.CloseCalls(), 1, "failed relay's connection closed")
+		assert.Len(t, relayClient.DataCalls(), 1)
+	})
+
+	t.Run("5xx reply", func(t *testing.T) {
+		primary, _ := newTestRelay("primary.example.com", &textproto.Error{Code: 550, Msg: "no such user"})
+		relay, relayClient := newTestRelay("relay.example.com", nil)
+		primary.relays, primary.relayState = []*Sender{relay}, &relayState{failedUntil: map[*Sender]time.Time{}}
+
+		_, err := primary.Deliver(context.Background(), "test body", params)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no such user")
+		assert.Empty(t, relayClient.MailCalls(), "permanent rejection is not retried with another relay")
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		relay1, _ := newTestRelay("relay1.example.com", &textproto.Error{Code: 421, Msg: "closing"})
+		relay2, _ := newTestRelay("relay2.example.com", &textproto.Error{Code: 452, Msg: "out of space"})
+		s := NewSender("primary.example.com", unreachable, Failover(time.Minute, relay1, relay2))
+
+		_, err := s.Deliver(context.Background(), "test body", params)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "all 3 relays failed, last error: bad from address")
+		assert.Contains(t, err.Error(), "out of space")
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		relay, relayClient := newTestRelay("relay.example.com", nil)
+		cancelingDial := DialContext(func(context.Context, string, string) (net.Conn, error) {
+			cancel()
+			return nil, context.Canceled
+		})
+		s := NewSender("primary.example.com", cancelingDial, Failover(time.Minute, relay))
+		_, err := s.Deliver(ctx, "test body", params)
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Empty(t, relayClient.MailCalls())
+	})
+}
+
+func TestEmail_DeliverFailoverCoolDown(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}}
+	primaryErr := error(&textproto.Error{Code: 421, Msg: "service not available"})
+	primary, primaryClient := newTestRelay("primary.example.com", nil)
+	primaryClient.MailFunc = func(string) error { return primaryErr }
+	relay, relayClient := newTestRelay("relay.example.com", nil)
+	primary.relays, primary.relayCoolDown = []*Sender{relay}, time.Minute
+	primary.relayState = &relayState{failedUntil: map[*Sender]time.Time{}}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	primary.timeNow = func() time.Time { return now }
+
+	res, err := primary.Deliver(context.Background(), "test body", params)
+	require.NoError(t, err)
+	assert.Equal(t, "relay.example.com:25", res.Relay)
+	assert.Len(t, primaryClient.MailCalls(), 1)
+
+	// primary is cooling down, the relay goes first
+	primaryErr = nil
+	res, err = primary.Deliver(context.Background(), "test body", params)
+	require.NoError(t, err)
+	assert.Equal(t, "relay.example.com:25", res.Relay)
+	assert.Len(t, primaryClient.MailCalls(), 1, "primary skipped")
+
+	// cooling down relay is still tried if the others fail
+	relayClient.MailFunc = func(string) error { return &textproto.Error{Code: 450, Msg: "busy"} }
+	res, err = primary.Deliver(context.Background(), "test body", params)
+	require.NoError(t, err)
+	assert.Equal(t, "primary.example.com:25", res.Relay)
+	assert.Len(t, primaryClient.MailCalls(), 2)
+
+	// primary delivered, not cooling down anymore, while the relay is
+	relayClient.MailFunc = func(string) error { return nil }
+	res, err = primary.Deliver(context.Background(), "test body", params)
+	require.NoError(t, err)
+	assert.Equal(t, "primary.example.com:25", res.Relay)
+
+	// cool-down is over
+	now = now.Add(2 * time.Minute)
+	primaryClient.MailFunc = func(string) error { return &textproto.Error{Code: 421, Msg: "service not available"} }
+	res, err = primary.Deliver(context.Background(), "test body", params)
+	require.NoError(t, err)
+	assert.Equal(t, "relay.example.com:25", res.Relay)
+}
+
+func TestTemporaryFailure(t *testing.T) {
+	assert.True(t, temporaryFailure(fmt.Errorf("wrapped: %w", &connectError{err: errors.New("refused")})))
+	assert.True(t, temporaryFailure(&connectError{err: &textproto.Error{Code: 554, Msg: "go away"}}), "greeting rejection")
+	assert.True(t, temporaryFailure(fmt.Errorf("bad from: %w", &textproto.Error{Code: 451})))
+	assert.False(t, temporaryFailure(fmt.Errorf("bad from: %w", &textproto.Error{Code: 550})))
+	assert.False(t, temporaryFailure(errors.New("write error")), "failure in the middle can't be retried safely")
+}
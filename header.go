@@ -0,0 +1,252 @@
+package email
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// header line limits, RFC 5322 section 2.1.1
+const (
+	maxHeaderLineLen     = 78  // recommended, the headers are folded to it where they can be
+	maxHeaderLineHardLen = 998 // the limit, a header which can't be folded to it is rejected
+	maxEncodedWordLen    = 75  // RFC 2047 section 2
+)
+
+// foldHeader returns the header line with the value, folded before the spaces to keep the lines within
+// maxHeaderLineLen. Runs without spaces are never broken, so a line stays longer if it has to,
+// failing if it exceeds maxHeaderLineHardLen. Line breaks already in the value are kept as folds.
+func foldHeader(name, value string) (string, error) {
+	buff := strings.Builder{}
+	for i, line := range strings.Split(name+": "+value, "\n") {
+		if i > 0 {
+			buff.WriteString("\n")
+		}
+		lineLen := 0
+		for j, word := range splitFoldable(line) {
+			// fold before the word, but not right after the header name, before the first word of a continuation line
+			// (it would leave an empty line, ending the header block), or leaving the line with the whitespace only
+			if (j > 1 || i > 0 && j > 0) && lineLen+len(word) > maxHeaderLineLen && strings.TrimSpace(word) != "" {
+				buff.WriteString("\n")
+				lineLen = 0
+			}
+			buff.WriteString(word)
+			lineLen += len(word)
+		}
+	}
+	res := buff.String()
+	for _, line := range strings.Split(res, "\n") {
+		if len(line) > maxHeaderLineHardLen {
+			return "", fmt.Errorf("header %s can't be folded to %d characters per line", name, maxHeaderLineHardLen)
+		}
+	}
+	return res, nil
+}
+
+// splitFoldable splits the line into the words with the whitespace before them, the places it can be folded at
+func splitFoldable(line string) []string {
+	var res []string
+	start := 0
+	for i := 1; i < len(line); i++ {
+		if (line[i] == ' ' || line[i] == '\t') && line[i-1] != ' ' && line[i-1] != '\t' {
+			res = append(res, line[start:i])
+			start = i
+		}
+	}
+	return append(res, line[start:])
+}
+
+// encodeText returns the unstructured header value, like the subject, ready for the header. ASCII value is kept
+// as is, to be folded at its spaces, unless it has a word too long for a line. Others are encoded as utf-8 encoded
+// words, RFC 2047, each on its own line, and split between the characters, never inside a multibyte one.
+func encodeText(name, value string) string {
+	if !needsEncodedWords(name, value) {
+		return value
+	}
+	room := maxHeaderLineLen - len(name+": ") // the first line, the next ones start with a space
+	var words []string
+	for value != "" {
+		n := encodedWordBytes(value, room)
+		words = append(words, "=?utf-8?b?"+base64.StdEncoding.EncodeToString([]byte(value[:n]))+"?=")
+		value = value[n:]
+		room = maxHeaderLineLen - 1
+	}
+	return strings.Join(words, "\n ")
+}
+
+// needsEncodedWords tells if the value can't go to the header as is, having non-printable or non-ASCII
+// characters, or a word which wouldn't fit the line
+func needsEncodedWords(name, value string) bool {
+	for i := 0; i < len(value); i++ {
+		if (value[i] < ' ' || value[i] > '~') && value[i] != '\t' {
+			return true
+		}
+	}
+	for i, word := range strings.Fields(value) {
+		if i == 0 {
+			word = name + ":" + word // stays on the line of the header name
+		}
+		if len(" "+word) > maxHeaderLineHardLen {
+			return true
+		}
+	}
+	return false
+}
+
+// encodedWordBytes returns how many bytes from the start of s go to the base64 encoded word fitting
+// into room characters, cut at the character boundary. At least one character is taken.
+func encodedWordBytes(s string, room int) int {
+	if room > maxEncodedWordLen {
+		room = maxEncodedWordLen
+	}
+	maxLen := (room - len("=?utf-8?b??=")) / 4 * 3 // bytes encoded into the room left
+	n := 0
+	for n < len(s) {
+		_, size := utf8.DecodeRuneInString(s[n:])
+		if n > 0 && n+size > maxLen {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// listHeaderURL returns the URL in angle brackets for List-* header, broken into the lines of maxHeaderLineLen
+// if it's longer, as the whitespace inside the brackets is ignored, RFC 2369 section 2
+func listHeaderURL(name, url string) string {
+	value := "<" + url + ">"
+	room := maxHeaderLineLen - len(name+": ")
+	var lines []string
+	for len(value) > room {
+		n := room
+		for n > 1 && !utf8.RuneStart(value[n]) {
+			n--
+		}
+		lines = append(lines, value[:n])
+		value = value[n:]
+		room = maxHeaderLineLen - 1
+	}
+	return strings.Join(append(lines, value), "\n ")
+}
+
+// builtinHeaders are the headers the message is built with, which can't be set with Params.Headers
+var builtinHeaders = []string{"From", "To", "X-Original-To", "Subject", "List-Unsubscribe", "List-Unsubscribe-Post",
+	"In-Reply-To", "MIME-Version", "Date", "Message-ID", "Content-Type", "Content-Transfer-Encoding"}
+
+// checkHeaderName rejects the name of the extra header which is not a valid field name, RFC 5322 section 2.2,
+// or the one of the headers the message is built with
+func checkHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid header name %q: empty", name)
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' || name[i] == ':' {
+			return fmt.Errorf("invalid header name %q: contains %q", name, name[i])
+		}
+	}
+	for _, h := range builtinHeaders {
+		if strings.EqualFold(name, h) {
+			return fmt.Errorf("invalid header name %q: set by the sender", name)
+		}
+	}
+	return nil
+}
+
+// sortedHeaderNames returns the names of the extra headers in the order they are written
+func sortedHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// randomID returns the random hex string making Message-ID unique
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b) // never fails on the supported platforms
+	return hex.EncodeToString(b)
+}
+
+// messageIDDomain returns the domain of Message-ID, the one of the sender address in ASCII form,
+// or "localhost" if it has none
+func messageIDDomain(from string) string {
+	addr := extractEmailAddress(from)
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || at == len(addr)-1 {
+		return "localhost"
+	}
+	domain, err := toASCIIDomain(addr[at+1:])
+	if err != nil {
+		return "localhost"
+	}
+	return domain
+}
+
+// partHeaderValue returns the value of the mime part header folded like foldHeader does, with CRLF line breaks,
+// as multipart.Writer writes the values as is
+func partHeaderValue(name, value string) (string, error) {
+	line, err := foldHeader(name, value)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(strings.TrimPrefix(line, name+": "), "\n", "\r\n"), nil
+}
+
+// formatMediaType formats the media type with the parameters like mime.FormatMediaType does, with a space
+// after each semicolon to fold the header at. A parameter too long for a line, like a long file name,
+// is split into RFC 2231 continuations, cut between the characters.
+func formatMediaType(mediaType string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	base := mime.FormatMediaType(mediaType, nil)
+	res := base
+	for _, k := range keys {
+		// formatted on its own to be quoted or encoded the standard way
+		param := strings.TrimPrefix(mime.FormatMediaType(mediaType, map[string]string{k: params[k]}), base+"; ")
+		if len(" "+param+";") <= maxHeaderLineLen-1 {
+			res += "; " + param
+			continue
+		}
+		for i, chunk := range paramChunks(params[k], maxHeaderLineLen-len(" "+k+"*00*=utf-8'';")) {
+			if i == 0 {
+				chunk = "utf-8''" + chunk
+			}
+			res += fmt.Sprintf("; %s*%d*=%s", k, i, chunk)
+		}
+	}
+	return res
+}
+
+// paramChunks percent-encodes the parameter value, RFC 2231, in chunks of at most size characters,
+// each made of whole characters of the value
+func paramChunks(value string, size int) []string {
+	var chunks []string
+	chunk := strings.Builder{}
+	for _, r := range value {
+		encoded := strings.Builder{}
+		for _, b := range []byte(string(r)) {
+			if b > ' ' && b < 0x7f && !strings.ContainsRune(`*'%()<>@,;:\"/[]?=`, rune(b)) {
+				encoded.WriteByte(b)
+				continue
+			}
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+		if chunk.Len() > 0 && chunk.Len()+encoded.Len() > size {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+		}
+		chunk.WriteString(encoded.String())
+	}
+	return append(chunks, chunk.String())
+}
@@ -0,0 +1,298 @@
+package email
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFoldHeader(t *testing.T) {
+	tbl := []struct {
+		name, value, out string
+	}{
+		{"Subject", "short one", "Subject: short one"},
+		{"Subject", "", "Subject: "},
+		{"Subject", strings.Repeat("word ", 20) + "end",
+			"Subject: word word word word word word word word word word word word word word\n" +
+				" word word word word word word end"},
+		{"Subject", "a  " + strings.Repeat("b", 80) + "  c", "Subject: a\n  " + strings.Repeat("b", 80) + "\n  c"},
+		{"Subject", strings.Repeat("x", 90), "Subject: " + strings.Repeat("x", 90)},
+		{"Subject", strings.Repeat("x", 70) + "   ", "Subject: " + strings.Repeat("x", 70) + "   "},
+		{"To", "a@example.com,\n b@example.com", "To: a@example.com,\n b@example.com"},
+		{"To", "a@example.com,\n " + strings.Repeat("x", 90) + "@example.com", "To: a@example.com,\n " + strings.Repeat("x", 90) + "@example.com"},
+		{"To", "a@example.com,\n " + strings.Repeat("b", 70) + " " + strings.Repeat("c", 10),
+			"To: a@example.com,\n " + strings.Repeat("b", 70) + "\n " + strings.Repeat("c", 10)},
+	}
+	for _, tt := range tbl {
+		out, err := foldHeader(tt.name, tt.value)
+		require.NoError(t, err)
+		assert.Equal(t, tt.out, out)
+		assert.Equal(t, strings.ReplaceAll(tt.name+": "+tt.value, "\n", ""), strings.ReplaceAll(out, "\n", ""), "unfolded back")
+	}
+
+	out, err := foldHeader("Subject", strings.Repeat("x", 989))
+	require.NoError(t, err, "998 characters")
+	assert.Len(t, out, maxHeaderLineHardLen)
+	_, err = foldHeader("In-reply-to", "<"+strings.Repeat("x", 1000)+">")
+	require.EqualError(t, err, "header In-reply-to can't be folded to 998 characters per line")
+}
+
+func TestEncodeSubject(t *testing.T) {
+	t.Run("ascii kept", func(t *testing.T) {
+		for _, subject := range []string{"", "subj", strings.Repeat("long subject ", 20), strings.Repeat("x", 989)} {
+			assert.Equal(t, subject, encodeText("Subject", subject))
+		}
+	})
+
+	tbl := map[string]string{
+		"short":               "non-ascii symbols: Привет",
+		"two-byte runes":      strings.Repeat("é", 100),
+		"three-byte runes":    strings.Repeat("日本語", 40),
+		"four-byte runes":     strings.Repeat("😀", 50),
+		"mixed offsets":       "a" + strings.Repeat("é日😀", 30) + "bc" + strings.Repeat("日😀é", 30),
+		"ascii word too long": strings.Repeat("x", 990),
+		"control character":   "bell\a",
+		"invalid utf-8":       "bad \xff\xfe bytes " + strings.Repeat("ü", 30),
+	}
+	for name, subject := range tbl {
+		t.Run(name, func(t *testing.T) {
+			encoded := encodeText("Subject", subject)
+			line, err := foldHeader("Subject", encoded)
+			require.NoError(t, err)
+			assert.Equal(t, "Subject: "+encoded, line, "already folded")
+
+			decoded := ""
+			for i, l := range strings.Split(line, "\n") {
+				assert.LessOrEqual(t, len(l), maxHeaderLineLen, l)
+				word := strings.TrimPrefix(l, "Subject: ")
+				if i > 0 {
+					require.True(t, strings.HasPrefix(word, " "), "folded line starts with a space: %q", l)
+					word = word[1:]
+				}
+				assert.LessOrEqual(t, len(word), maxEncodedWordLen)
+				require.True(t, strings.HasPrefix(word, "=?utf-8?b?") && strings.HasSuffix(word, "?="), word)
+				data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(word, "=?utf-8?b?"), "?="))
+				require.NoError(t, err)
+				if utf8.ValidString(subject) {
+					assert.True(t, utf8.Valid(data), "no character broken between the words: %q", data)
+				}
+				decoded += string(data)
+			}
+			assert.Equal(t, subject, decoded)
+		})
+	}
+}
+
+func TestEncodedWordBytes(t *testing.T) {
+	assert.Equal(t, 42, encodedWordBytes(strings.Repeat("a", 100), 69))
+	assert.Equal(t, 45, encodedWordBytes(strings.Repeat("a", 100), 100), "limited to 75 characters of the encoded word")
+	assert.Equal(t, 3, encodedWordBytes("abc", 69))
+	assert.Equal(t, 40, encodedWordBytes(strings.Repeat("😀", 20), 69), "cut before the rune not fitting")
+	assert.Equal(t, 4, encodedWordBytes("😀😀", 16), "at least one rune, even not fitting")
+	assert.Equal(t, 0, encodedWordBytes("", 69))
+}
+
+func TestListHeaderURL(t *testing.T) {
+	assert.Equal(t, "<https://example.com/unsubscribe>", listHeaderURL("List-Unsubscribe", "https://example.com/unsubscribe"))
+
+	url := "https://example.com/unsubscribe?token=" + strings.Repeat("0123456789abcdef", 20)
+	value := listHeaderURL("List-Unsubscribe", url)
+	line, err := foldHeader("List-Unsubscribe", value)
+	require.NoError(t, err)
+	lines := strings.Split(line, "\n")
+	require.Greater(t, len(lines), 3)
+	for i, l := range lines {
+		assert.LessOrEqual(t, len(l), maxHeaderLineLen, l)
+		if i > 0 {
+			assert.True(t, strings.HasPrefix(l, " "), l)
+		}
+	}
+	assert.Equal(t, "<"+url+">", strings.ReplaceAll(value, "\n ", ""), "whitespace inside the brackets is ignored")
+
+	value = listHeaderURL("List-Unsubscribe", "https://example.com/"+strings.Repeat("ü", 60))
+	for _, l := range strings.Split(value, "\n") {
+		assert.True(t, utf8.ValidString(l), l)
+	}
+}
+
+func TestEmail_BuildMessageFoldedHeaders(t *testing.T) {
+	to := make([]string, 0, 30)
+	for i := 0; i < 30; i++ {
+		to = append(to, "Получатель <recipient@example.com>")
+	}
+	params := Params{From: "from@example.com", To: to, Subject: strings.Repeat("Длинная тема письма ", 10),
+		UnsubscribeLink: "https://example.com/unsubscribe?token=" + strings.Repeat("abcdef", 30),
+		InReplyTo:       "uuid@example.com", Attachments: []string{"testdata/1.txt"}, InlineImages: []string{"testdata/image.jpg"}}
+	msg, err := NewSender("localhost", ContentType("text/html")).BuildMessage("body", params)
+	require.NoError(t, err)
+
+	head := string(msg.Data[:strings.Index(string(msg.Data), "\r\n--")])
+	for _, line := range strings.Split(strings.ReplaceAll(head, "\r\n", "\n"), "\n") {
+		assert.LessOrEqual(t, len(line), maxHeaderLineLen, line)
+	}
+
+	parsed, err := ParseMessage(msg.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, params.Subject, parsed.Subject)
+	assert.Len(t, parsed.To, 30)
+	assert.Equal(t, "Получатель", parsed.To[29].Name)
+	assert.Equal(t, "<"+params.UnsubscribeLink+">", strings.ReplaceAll(parsed.Header.Get("List-Unsubscribe"), " ", ""))
+	assert.Equal(t, "body", strings.TrimSpace(parsed.HTML))
+	require.Len(t, parsed.Attachments, 1)
+	require.Len(t, parsed.Inline, 1)
+
+	params.InReplyTo = strings.Repeat("x", 1000) + "@example.com"
+	_, err = NewSender("localhost").BuildMessage("body", params)
+	require.EqualError(t, err, "can't make email message: header In-reply-to can't be folded to 998 characters per line")
+}
+
+func TestEmail_BuildMessageExtraHeaders(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj",
+		Headers: map[string]string{"X-Priority": "1", "X-Campaign": strings.Repeat("Весенняя рассылка ", 10),
+			"X-Tags": strings.Repeat("tag ", 30)}}
+	msg, err := NewSender("localhost").BuildMessage("body", params)
+	require.NoError(t, err)
+
+	head := string(msg.Data[:strings.Index(string(msg.Data), "\r\n\r\n")])
+	for _, line := range strings.Split(head, "\r\n") {
+		assert.LessOrEqual(t, len(line), maxHeaderLineLen, line)
+	}
+	assert.Less(t, strings.Index(head, "X-Campaign:"), strings.Index(head, "X-Priority:"), "in the order of the names")
+	assert.Less(t, strings.Index(head, "X-Priority:"), strings.Index(head, "X-Tags:"))
+
+	parsed, err := ParseMessage(msg.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, "1", parsed.Header.Get("X-Priority"))
+	campaign, err := (&mime.WordDecoder{}).DecodeHeader(parsed.Header.Get("X-Campaign"))
+	require.NoError(t, err)
+	assert.Equal(t, params.Headers["X-Campaign"], campaign)
+	assert.Equal(t, strings.Fields(params.Headers["X-Tags"]), strings.Fields(parsed.Header.Get("X-Tags")))
+	assert.Equal(t, "body", strings.TrimSpace(parsed.Text))
+
+	for _, name := range []string{"", "X Campaign", "X-Campaign:", "X-Кампания", "Message-Id", "in-reply-to"} {
+		_, err = NewSender("localhost").BuildMessage("body", Params{From: "from@example.com",
+			To: []string{"to@example.com"}, Headers: map[string]string{name: "value"}})
+		assert.ErrorContains(t, err, "invalid header name", name)
+	}
+}
+
+func TestBuildMessageID(t *testing.T) {
+	assert.Equal(t, "example.com", messageIDDomain("Me <me@example.com>"))
+	assert.Equal(t, "xn--bcher-kva.de", messageIDDomain("me@bücher.de"))
+	assert.Equal(t, "localhost", messageIDDomain("me"))
+	assert.Equal(t, "localhost", messageIDDomain("me@"))
+
+	assert.Regexp(t, "^[0-9a-f]{32}$", randomID())
+	assert.NotEqual(t, randomID(), randomID())
+
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}}
+	first, err := NewSender("localhost").BuildMessage("text", params)
+	require.NoError(t, err)
+	second, err := NewSender("localhost").BuildMessage("text", params)
+	require.NoError(t, err)
+	id := messageID(first.Data)
+	assert.Regexp(t, `^<[0-9a-f]{32}@example\.com>$`, id)
+	assert.NotEqual(t, id, messageID(second.Data), "unique for each message")
+}
+
+func TestFormatMediaType(t *testing.T) {
+	short := map[string]string{"name": "report.pdf", "charset": "utf-8"}
+	assert.Equal(t, mime.FormatMediaType("text/plain", short), formatMediaType("text/plain", short))
+	nonASCII := map[string]string{"filename": "résumé.pdf"}
+	assert.Equal(t, mime.FormatMediaType("attachment", nonASCII), formatMediaType("attachment", nonASCII))
+
+	for _, name := range []string{
+		strings.Repeat("long_file_name_", 10) + ".txt",
+		strings.Repeat("long file name ", 10) + ".txt",
+		strings.Repeat("длинное имя файла ", 6) + ".txt",
+		strings.Repeat("日本語😀é", 15) + ".txt",
+	} {
+		t.Run(name, func(t *testing.T) {
+			value := formatMediaType("attachment", map[string]string{"filename": name})
+			out, err := partHeaderValue("Content-Disposition", value)
+			require.NoError(t, err)
+			lines := strings.Split("Content-Disposition: "+out, "\r\n")
+			require.Greater(t, len(lines), 1, "folded")
+			for i, line := range lines {
+				assert.LessOrEqual(t, len(line), maxHeaderLineLen, line)
+				if i > 0 {
+					assert.True(t, strings.HasPrefix(line, " "), line)
+				}
+			}
+
+			disposition, params, err := mime.ParseMediaType(strings.ReplaceAll(out, "\r\n", ""))
+			require.NoError(t, err)
+			assert.Equal(t, "attachment", disposition)
+			assert.Equal(t, name, params["filename"], "continuations joined back")
+		})
+	}
+}
+
+func TestParamChunks(t *testing.T) {
+	assert.Equal(t, []string{"abc"}, paramChunks("abc", 10))
+	assert.Equal(t, []string{"a%20b"}, paramChunks("a b", 10))
+	assert.Equal(t, []string{"abcd", "ef"}, paramChunks("abcdef", 4))
+	assert.Equal(t, []string{"%C3%A9", "%C3%A9"}, paramChunks("éé", 8), "the character isn't split between chunks")
+	assert.Equal(t, []string{"%F0%9F%98%80"}, paramChunks("😀", 4), "at least one character in a chunk")
+	for _, chunk := range paramChunks(strings.Repeat("日本語", 20), 20) {
+		decoded, err := url.PathUnescape(chunk)
+		require.NoError(t, err)
+		assert.True(t, utf8.ValidString(decoded), chunk)
+	}
+}
+
+func TestEmail_BuildMessageLongFileName(t *testing.T) {
+	name := strings.Repeat("очень длинное имя файла ", 5) + "image.jpg"
+	path := filepath.Join(t.TempDir(), name)
+	data, err := os.ReadFile("testdata/image.jpg")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	msg, err := NewSender("localhost", ContentType("text/html")).BuildMessage("<img src=\"cid:image\">",
+		Params{From: "from@example.com", To: []string{"to@example.com"}, Attachments: []string{path}, InlineImages: []string{path}})
+	require.NoError(t, err)
+	for _, line := range strings.Split(string(msg.Data), "\r\n") {
+		assert.LessOrEqual(t, len(line), maxHeaderLineLen, line)
+	}
+
+	parsed, err := ParseMessage(msg.Reader())
+	require.NoError(t, err)
+	require.Len(t, parsed.Attachments, 1)
+	assert.Equal(t, name, parsed.Attachments[0].FileName)
+	assert.Equal(t, data, parsed.Attachments[0].Data)
+	require.Len(t, parsed.Inline, 1)
+	assert.Equal(t, name, parsed.Inline[0].FileName)
+	assert.Equal(t, name, parsed.Inline[0].ContentID)
+}
+
+func TestEmail_BuildMessageLongAddresses(t *testing.T) {
+	long := "bounce-" + strings.Repeat("x", 80) + "@example.com" // like VERP addresses
+	params := Params{From: "from@example.com", To: []string{"a@example.com", long}, Subject: "subj"}
+	msg, err := NewSender("localhost").BuildMessage("body", params)
+	require.NoError(t, err)
+	head := string(msg.Data[:strings.Index(string(msg.Data), "\r\n\r\n")])
+	assert.NotContains(t, head, "\r\n\r\n", "no empty line inside the headers")
+
+	parsed, err := ParseMessage(msg.Reader())
+	require.NoError(t, err)
+	require.Len(t, parsed.To, 2)
+	assert.Equal(t, long, parsed.To[1].Address)
+	assert.Equal(t, "subj", parsed.Subject)
+	assert.Equal(t, "body", parsed.Text)
+
+	redirected, err := NewSender("localhost", RedirectAll("qa@example.com")).BuildMessage("body", params)
+	require.NoError(t, err)
+	parsed, err = ParseMessage(redirected.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com,"+long, strings.ReplaceAll(parsed.Header.Get("X-Original-To"), " ", ""))
+	assert.Equal(t, "subj", parsed.Subject)
+	assert.Equal(t, "body", parsed.Text)
+}
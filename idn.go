@@ -0,0 +1,172 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrSMTPUTF8Required is the failure to send to or from the address with non-ASCII local part, like
+// "пользователь@пример.рф", through the server not supporting SMTPUTF8 extension, RFC 6531.
+// Such local part has no ASCII form, unlike the domain which is converted to punycode.
+var ErrSMTPUTF8Required = errors.New("non-ASCII local part requires SMTPUTF8, not supported by the server")
+
+// supportsSMTPUTF8 tells if the server advertises SMTPUTF8, clients not reporting the extensions are assumed not to
+func supportsSMTPUTF8(client SMTPClient) bool {
+	reporter, ok := client.(extensionReporter)
+	if !ok {
+		return false
+	}
+	supported, _ := reporter.Extension("SMTPUTF8")
+	return supported
+}
+
+// envelopeAddress returns the address for MAIL FROM or RCPT TO. With SMTPUTF8 the address goes as is,
+// otherwise its domain is converted to punycode, and non-ASCII local part fails with ErrSMTPUTF8Required.
+func envelopeAddress(addr string, smtputf8 bool) (string, error) {
+	if isASCII(addr) || smtputf8 {
+		return addr, nil
+	}
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || !isASCII(addr[:at]) {
+		return "", ErrSMTPUTF8Required
+	}
+	domain, err := toASCIIDomain(addr[at+1:])
+	if err != nil {
+		return "", err
+	}
+	return addr[:at+1] + domain, nil
+}
+
+// toASCIIDomain converts the internationalized domain to its ASCII form, with each non-ASCII label lowercased
+// and encoded with punycode, RFC 5891. Labels are not mapped beyond lowercasing, as UTS 46 would do.
+func toASCIIDomain(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+	// ideographic and fullwidth full stops separate labels as well, RFC 3490 section 3.1
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := punycode(strings.ToLower(label))
+		if err != nil {
+			return "", fmt.Errorf("can't convert domain %q to ascii: %w", domain, err)
+		}
+		labels[i] = "xn--" + encoded
+		if len(labels[i]) > 63 {
+			return "", fmt.Errorf("can't convert domain %q to ascii: label %q is longer than 63 characters", domain, labels[i])
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycode parameters, RFC 3492 section 5
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycode encodes the label with punycode, RFC 3492 section 6.3
+func punycode(label string) (string, error) {
+	if !utf8.ValidString(label) {
+		return "", fmt.Errorf("invalid utf-8 in %q", label)
+	}
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		next := rune(utf8.MaxRune + 1)
+		for _, r := range runes {
+			if r >= n && r < next {
+				next = r
+			}
+		}
+		if int(next-n) > (1<<31-1-delta)/(handled+1) {
+			return "", fmt.Errorf("overflow encoding %q", label)
+		}
+		delta += int(next-n) * (handled + 1)
+		n = next
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				switch {
+				case t < punyTMin:
+					t = punyTMin
+				case t > punyTMax:
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punyAdapt is the bias adaptation function, RFC 3492 section 6.1
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
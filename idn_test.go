@@ -0,0 +1,143 @@
+package email
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_SendIDN(t *testing.T) {
+	params := Params{From: "from@bücher.de", To: []string{"Иван <ivan@пример.рф>"}, Subject: "idn"}
+
+	t.Run("punycode without smtputf8", func(t *testing.T) {
+		host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+			{"EHLO localhost", "250-smtp.example.net\r\n250 8BITMIME"},
+			{"MAIL FROM:<from@xn--bcher-kva.de> BODY=8BITMIME", "250 ok"},
+			{"RCPT TO:<ivan@xn--e1afmkfd.xn--p1ai>", "250 ok"},
+			{"DATA", "354 go ahead"},
+			{"", "250 queued"},
+			{"QUIT", "221 bye"},
+		}))
+		res, err := NewSender(host, Port(port)).Deliver(context.Background(), "body", params)
+		require.NoError(t, err)
+		waitSMTPTestServer(t, done)
+		assert.Equal(t, []RecipientStatus{{Address: "ivan@xn--e1afmkfd.xn--p1ai"}}, res.Recipients)
+	})
+
+	t.Run("utf-8 with smtputf8", func(t *testing.T) {
+		host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+			{"EHLO localhost", "250-smtp.example.net\r\n250-8BITMIME\r\n250 SMTPUTF8"},
+			{"MAIL FROM:<отправитель@bücher.de> BODY=8BITMIME SMTPUTF8", "250 ok"},
+			{"RCPT TO:<пользователь@пример.рф>", "250 ok"},
+			{"DATA", "354 go ahead"},
+			{"", "250 queued"},
+			{"QUIT", "221 bye"},
+		}))
+		err := NewSender(host, Port(port)).Send("body", Params{From: "отправитель@bücher.de", To: []string{"пользователь@пример.рф"}})
+		require.NoError(t, err)
+		waitSMTPTestServer(t, done)
+	})
+
+	t.Run("utf-8 local part without smtputf8", func(t *testing.T) {
+		host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+			{"EHLO localhost", "250-smtp.example.net\r\n250 8BITMIME"},
+			{"MAIL FROM:<from@example.com> BODY=8BITMIME", "250 ok"},
+		}))
+		err := NewSender(host, Port(port)).Send("body", Params{From: "from@example.com", To: []string{"пользователь@пример.рф"}})
+		waitSMTPTestServer(t, done)
+		require.ErrorIs(t, err, ErrSMTPUTF8Required)
+		assert.EqualError(t, err, `bad to address "пользователь@пример.рф": `+
+			"non-ASCII local part requires SMTPUTF8, not supported by the server")
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		msg, err := NewSender("localhost").BuildMessage("body", params)
+		require.NoError(t, err)
+		assert.Contains(t, string(msg.Data), "From: from@xn--bcher-kva.de\r\nTo: =?utf-8?q?=D0=98=D0=B2=D0=B0=D0=BD?= <ivan@xn--e1afmkfd.xn--p1ai>\r\n")
+		assert.Equal(t, Envelope{From: "from@bücher.de", To: []string{"ivan@пример.рф"}}, msg.Envelope,
+			"converted when sent, the server may support SMTPUTF8")
+	})
+
+	t.Run("mx of idn domain", func(t *testing.T) {
+		servers := newMXTestServers(map[string]string{"mx.xn--e1afmkfd.xn--p1ai:25": "250 ok"})
+		resolver := mxTestResolver{"xn--e1afmkfd.xn--p1ai": {{Host: "mx.xn--e1afmkfd.xn--p1ai.", Pref: 10}}}
+		s := NewSender("ignored.example.com", DirectMX(resolver), DialContext(servers.dial()))
+		res, err := s.Deliver(context.Background(), "body", Params{From: "from@example.com", To: []string{"ivan@пример.рф"}})
+		require.NoError(t, err)
+		assert.Equal(t, "mx.xn--e1afmkfd.xn--p1ai:25", res.Relay)
+		assert.Equal(t, []string{"RCPT TO:<ivan@xn--e1afmkfd.xn--p1ai>"}, servers.rcpts("mx.xn--e1afmkfd.xn--p1ai:25"))
+	})
+}
+
+func TestPunycode(t *testing.T) {
+	tbl := []struct{ in, out string }{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"пример", "e1afmkfd"},
+		{"рф", "p1ai"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},                            // RFC 3492 section 7.1, sample B
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},                             // sample J
+		{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},                      // sample A
+		{"почемужеонинеговорятпорусски", "b1abfaaepdrnnbgefbadotcwatmq2g4l"}, // sample I
+	}
+	for _, tt := range tbl {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := punycode(tt.in)
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, out)
+		})
+	}
+
+	_, err := punycode("bad\xff")
+	require.Error(t, err)
+}
+
+func TestToASCIIDomain(t *testing.T) {
+	tbl := []struct{ in, out, err string }{
+		{"example.com", "example.com", ""},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai", ""},
+		{"Bücher.DE", "xn--bcher-kva.DE", ""},
+		{"bücher。de", "xn--bcher-kva.de", ""},
+		{strings.Repeat("bücher", 11) + ".de", "", "is longer than 63 characters"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := toASCIIDomain(tt.in)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, out)
+		})
+	}
+}
+
+func TestEnvelopeAddress(t *testing.T) {
+	tbl := []struct {
+		addr     string
+		smtputf8 bool
+		out      string
+		err      error
+	}{
+		{"user@example.com", false, "user@example.com", nil},
+		{"user@bücher.de", false, "user@xn--bcher-kva.de", nil},
+		{"user@bücher.de", true, "user@bücher.de", nil},
+		{"пользователь@пример.рф", true, "пользователь@пример.рф", nil},
+		{"пользователь@пример.рф", false, "", ErrSMTPUTF8Required},
+		{"пользователь", false, "", ErrSMTPUTF8Required},
+	}
+	for _, tt := range tbl {
+		out, err := envelopeAddress(tt.addr, tt.smtputf8)
+		if tt.err != nil {
+			assert.ErrorIs(t, err, tt.err, tt.addr)
+			continue
+		}
+		require.NoError(t, err, tt.addr)
+		assert.Equal(t, tt.out, out, tt.addr)
+	}
+}
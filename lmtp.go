@@ -0,0 +1,224 @@
+package email
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// lmtpClient is LMTP client, RFC 2033. net/smtp can't be used for it as it always greets with EHLO
+// and reads a single reply to the message, while LMTP server replies for each accepted recipient.
+type lmtpClient struct {
+	text       *textproto.Conn
+	serverName string
+	tls        bool
+	ext        map[string]string // supported extensions, from LHLO reply
+	rcpts      []string          // accepted recipients, each gets a reply after the message
+	statuses   []RecipientStatus // per-recipient replies to the last message
+}
+
+// lmtpClient makes LMTP client with the connection bound to ctx, see connect for the details
+func (em *Sender) lmtpClient(ctx context.Context, rec *transcript) (c *lmtpClient, stop func(), err error) {
+	if !em.tls && em.starttls == StartTLSRequired {
+		return nil, nil, errors.New("STARTTLS is not supported with LMTP")
+	}
+	conn, _, stop, err := em.connect(ctx, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	localName := em.heloHost
+	if localName == "" {
+		localName = "localhost"
+	}
+	if c, err = newLMTPClient(conn, em.host, localName); err != nil {
+		stop()
+		_ = conn.Close()
+		_, srvAddress := em.serverAddress()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, fmt.Errorf("failed to make lmtp client for %s: %w", srvAddress, ctxErr)
+		}
+		return nil, nil, fmt.Errorf("failed to make lmtp client for %s: %w", srvAddress, err)
+	}
+	return c, stop, nil
+}
+
+// newLMTPClient reads the server greeting from conn and greets it with LHLO
+func newLMTPClient(conn net.Conn, serverName, localName string) (*lmtpClient, error) {
+	c := &lmtpClient{text: textproto.NewConn(conn), serverName: serverName}
+	c.tls = isTLSConn(conn)
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return nil, err
+	}
+	if err := validateLine(localName); err != nil {
+		return nil, err
+	}
+	_, msg, err := c.cmd(250, "LHLO %s", localName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send LMTP greeting: %w", err)
+	}
+
+	c.ext = map[string]string{}
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] { // the first line is the server name
+		k, v, _ := strings.Cut(line, " ")
+		c.ext[strings.ToUpper(k)] = v
+	}
+	return c, nil
+}
+
+// cmd sends the command and reads the reply, failing on unexpected reply code
+func (c *lmtpClient) cmd(expectCode int, format string, args ...interface{}) (code int, msg string, err error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expectCode)
+}
+
+// Extension reports whether the server supports the extension, with its parameters
+func (c *lmtpClient) Extension(ext string) (supported bool, params string) {
+	params, supported = c.ext[strings.ToUpper(ext)]
+	return supported, params
+}
+
+// Auth authenticates with the mechanism, the same way smtp.Client does
+func (c *lmtpClient) Auth(a smtp.Auth) error {
+	_, authParams := c.Extension("AUTH")
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: c.serverName, TLS: c.tls, Auth: strings.Fields(authParams)})
+	if err != nil {
+		_, _, _ = c.cmd(0, "QUIT")
+		return err
+	}
+	code, msg64, err := c.cmd(0, "%s", strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, base64.StdEncoding.EncodeToString(resp))))
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = base64.StdEncoding.DecodeString(msg64)
+		case 235:
+			msg = []byte(msg64) // the server is done, the mechanism can check the final message
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			_, _, _ = c.cmd(501, "*") // abort the exchange
+			break
+		}
+		if resp == nil {
+			break
+		}
+		code, msg64, err = c.cmd(0, "%s", base64.StdEncoding.EncodeToString(resp))
+	}
+	return err
+}
+
+// Mail starts the transaction with the envelope sender
+func (c *lmtpClient) Mail(from string) error {
+	return c.mail(from, 0)
+}
+
+// mail starts the transaction, declaring the message size if it's known and the server supports SIZE
+func (c *lmtpClient) mail(from string, size int64) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	c.rcpts, c.statuses = nil, nil
+	cmd := "MAIL FROM:<%s>"
+	if _, ok := c.ext["8BITMIME"]; ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if _, ok := c.ext["SMTPUTF8"]; ok {
+		cmd += " SMTPUTF8"
+	}
+	if _, ok := c.ext["SIZE"]; ok && size > 0 {
+		cmd += " SIZE=" + strconv.FormatInt(size, 10)
+	}
+	_, _, err := c.cmd(250, cmd, from)
+	return err
+}
+
+// Rcpt adds the envelope recipient, the accepted ones get a reply each after the message
+func (c *lmtpClient) Rcpt(to string) error {
+	if err := validateLine(to); err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
+		return err
+	}
+	c.rcpts = append(c.rcpts, to)
+	return nil
+}
+
+// Data starts the message, closing the returned writer reads the replies for all recipients
+func (c *lmtpClient) Data() (io.WriteCloser, error) {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	return &lmtpDataWriter{WriteCloser: c.text.DotWriter(), c: c}, nil
+}
+
+// Quit ends the session and closes the connection
+func (c *lmtpClient) Quit() error {
+	if _, _, err := c.cmd(221, "QUIT"); err != nil {
+		return err
+	}
+	return c.text.Close()
+}
+
+// Close closes the connection
+func (c *lmtpClient) Close() error {
+	return c.text.Close()
+}
+
+// lmtpDataWriter writes the message with dot-stuffing and reads the per-recipient replies on close
+type lmtpDataWriter struct {
+	io.WriteCloser
+	c *lmtpClient
+}
+
+// Close terminates the message and reads a reply for each accepted recipient, in the order they were given.
+// Rejection for some of recipients is reported with *RecipientsError, a failure to read the replies as is.
+func (w *lmtpDataWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	var failed bool
+	statuses := make([]RecipientStatus, 0, len(w.c.rcpts))
+	for _, rcpt := range w.c.rcpts {
+		code, msg, err := w.c.text.ReadResponse(250)
+		var protoErr *textproto.Error
+		if err != nil && !errors.As(err, &protoErr) {
+			return err // the connection is broken, the rest of replies can't be read
+		}
+		statuses = append(statuses, RecipientStatus{Address: rcpt, Code: code, Message: msg, Err: err})
+		failed = failed || err != nil
+	}
+
+	w.c.statuses = statuses
+	if failed {
+		return &RecipientsError{Recipients: statuses}
+	}
+	return nil
+}
+
+// validateLine rejects a command argument with CR or LF, which would end the command and start another one
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return fmt.Errorf("invalid command argument %q: contains CR or LF", line)
+	}
+	return nil
+}
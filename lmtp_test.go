@@ -0,0 +1,253 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_DeliverLMTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		replies    []string // replies after the message, one per recipient
+		wantErr    string
+		wantResult []RecipientStatus
+	}{
+		{
+			name:    "delivered to all",
+			replies: []string{"250 2.1.5 <to1@example.com> delivered", "250 2.1.5 <to2@example.com> delivered"},
+			wantResult: []RecipientStatus{
+				{Address: "to1@example.com", Code: 250, Message: "2.1.5 <to1@example.com> delivered"},
+				{Address: "to2@example.com", Code: 250, Message: "2.1.5 <to2@example.com> delivered"},
+			},
+		},
+		{
+			name:    "rejected for one",
+			replies: []string{"452 4.2.2 <to1@example.com> mailbox full", "250 2.1.5 <to2@example.com> delivered"},
+			wantErr: "rejected for 1 of 2 recipients, to1@example.com: 452",
+			wantResult: []RecipientStatus{
+				{Address: "to1@example.com", Code: 452, Message: "4.2.2 <to1@example.com> mailbox full",
+					Err: &textproto.Error{Code: 452, Msg: "4.2.2 <to1@example.com> mailbox full"}},
+				{Address: "to2@example.com", Code: 250, Message: "2.1.5 <to2@example.com> delivered"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket, done := startUnixTestServer(t, func(conn net.Conn) error {
+				if err := writeSMTPResponse(conn, "220 lmtp.example.net LMTP ready"); err != nil {
+					return err
+				}
+				reader := bufio.NewReader(conn)
+				for _, exchange := range [][2]string{
+					{"LHLO client.example.net", "250-lmtp.example.net\r\n250-8BITMIME\r\n250 ENHANCEDSTATUSCODES"},
+					{"MAIL FROM:<from@example.com> BODY=8BITMIME", "250 2.1.0 ok"},
+					{"RCPT TO:<to1@example.com>", "250 2.1.5 ok"},
+					{"RCPT TO:<to2@example.com>", "250 2.1.5 ok"},
+					{"DATA", "354 go ahead"},
+				} {
+					cmd, err := readSMTPCommand(reader)
+					if err != nil {
+						return err
+					}
+					if cmd != exchange[0] {
+						return fmt.Errorf("unexpected command %q, want %q", cmd, exchange[0])
+					}
+					if err = writeSMTPResponse(conn, exchange[1]); err != nil {
+						return err
+					}
+				}
+				if err := readSMTPData(reader); err != nil {
+					return err
+				}
+				if _, err := io.WriteString(conn, strings.Join(tt.replies, "\r\n")+"\r\n"); err != nil {
+					return err
+				}
+				if tt.wantErr != "" {
+					return nil
+				}
+				return expectSMTPQuit(conn, reader)
+			})
+
+			s := NewSender("localhost", UnixSocket(socket), LMTP(true), HELOHost("client.example.net"), TimeOut(time.Second*3))
+			res, err := s.Deliver(context.Background(), "test body",
+				Params{From: "from@example.com", To: []string{"to1@example.com", `"Two" <to2@example.com>`}, Subject: "subj"})
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				var rcptErr *RecipientsError
+				require.ErrorAs(t, err, &rcptErr)
+				assert.Equal(t, tt.wantResult, rcptErr.Recipients)
+			} else {
+				require.NoError(t, err)
+			}
+			require.NotNil(t, res)
+			assert.Equal(t, tt.wantResult, res.Recipients)
+			waitSMTPTestServer(t, done)
+		})
+	}
+}
+
+func TestEmail_SendLMTPOverTCPWithAuth(t *testing.T) {
+	host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+		if err := writeSMTPResponse(conn, "220 lmtp.example.net LMTP ready"); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		for _, exchange := range [][2]string{
+			{"LHLO localhost", "250-lmtp.example.net\r\n250 AUTH LOGIN"},
+			{"AUTH LOGIN dXNlcg==", "334 UGFzc3dvcmQ6"},
+			{"cGFzcw==", "235 authenticated"},
+			{"MAIL FROM:<from@example.com>", "250 ok"},
+			{"RCPT TO:<to@example.com>", "250 ok"},
+			{"DATA", "354 go ahead"},
+		} {
+			cmd, err := readSMTPCommand(reader)
+			if err != nil {
+				return err
+			}
+			if cmd != exchange[0] {
+				return fmt.Errorf("unexpected command %q, want %q", cmd, exchange[0])
+			}
+			if err = writeSMTPResponse(conn, exchange[1]); err != nil {
+				return err
+			}
+		}
+		if err := readSMTPData(reader); err != nil {
+			return err
+		}
+		if err := writeSMTPResponse(conn, "250 delivered"); err != nil {
+			return err
+		}
+		return expectSMTPQuit(conn, reader)
+	})
+
+	s := NewSender(host, Port(port), LMTP(true), Auth("user", "pass"), AutoAuth(), TimeOut(time.Second*3))
+	require.NoError(t, s.Send("test body", Params{From: "from@example.com", To: []string{"to@example.com"}}))
+	waitSMTPTestServer(t, done)
+}
+
+func TestEmail_SendSMTPUnixSocket(t *testing.T) {
+	socket, done := startUnixTestServer(t, greetAndQuitSMTPHandler(nil))
+	client, _, err := NewSender("localhost", UnixSocket(socket), SourceAddr("127.0.0.1")).client(context.Background(), nil)
+	require.NoError(t, err, "source address ignored for unix socket")
+	require.NoError(t, client.Quit())
+	waitSMTPTestServer(t, done)
+}
+
+func TestEmail_LMTPClientErrors(t *testing.T) {
+	_, _, err := NewSender("localhost", LMTP(true), STARTTLS(true)).lmtpClient(context.Background(), nil)
+	require.EqualError(t, err, "STARTTLS is not supported with LMTP")
+
+	_, _, err = NewSender("localhost", UnixSocket("/tmp/nothing.sock"), SOCKS5Proxy("127.0.0.1:1080", "", "")).
+		client(context.Background(), nil)
+	require.EqualError(t, err, "can't connect to unix socket /tmp/nothing.sock through socks5 proxy")
+
+	socket, done := startUnixTestServer(t, func(conn net.Conn) error {
+		if err := writeSMTPResponse(conn, "220 lmtp.example.net LMTP ready"); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		if _, err := readSMTPCommand(reader); err != nil {
+			return err
+		}
+		if err := writeSMTPResponse(conn, "500 unknown command"); err != nil {
+			return err
+		}
+		return expectSMTPConnectionClosed(conn, reader)
+	})
+	_, _, err = NewSender("localhost", UnixSocket(socket), LMTP(true)).lmtpClient(context.Background(), nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to make lmtp client for "+socket+": failed to send LMTP greeting: 500")
+	waitSMTPTestServer(t, done)
+}
+
+func TestLMTPClient_BrokenReplies(t *testing.T) {
+	server, clientConn := net.Pipe()
+	defer server.Close()
+	go func() {
+		reader := bufio.NewReader(server)
+		_ = writeSMTPResponse(server, "220 lmtp.example.net")
+		for _, resp := range []string{"250 lmtp.example.net", "250 ok", "250 ok", "250 ok", "354 go ahead"} {
+			if _, err := readSMTPCommand(reader); err != nil {
+				return
+			}
+			_ = writeSMTPResponse(server, resp)
+		}
+		_ = readSMTPData(reader)
+		_ = writeSMTPResponse(server, "250 delivered") // one reply of two, then the connection is gone
+		_ = server.Close()
+	}()
+
+	c, err := newLMTPClient(clientConn, "localhost", "localhost")
+	require.NoError(t, err)
+	require.NoError(t, c.Mail("from@example.com"))
+	require.NoError(t, c.Rcpt("to1@example.com"))
+	require.NoError(t, c.Rcpt("to2@example.com"))
+	require.Error(t, c.Rcpt("bad\r\nDATA"), "CRLF rejected before sending")
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "test body\r\n")
+	require.NoError(t, err)
+	err = w.Close()
+	require.Error(t, err)
+	var rcptErr *RecipientsError
+	assert.False(t, errors.As(err, &rcptErr), "broken connection is not a rejection")
+}
+
+func TestRecipientsError(t *testing.T) {
+	err := &RecipientsError{Recipients: []RecipientStatus{
+		{Address: "a@example.com", Err: errors.New("550 no such user")},
+		{Address: "b@example.com"},
+		{Address: "c@example.com", Err: errors.New("452 mailbox full")},
+	}}
+	assert.EqualError(t, err, "rejected for 2 of 3 recipients, a@example.com: 550 no such user; c@example.com: 452 mailbox full")
+}
+
+// startUnixTestServer is startSMTPTestServer listening on a unix socket, returns the socket path
+func startUnixTestServer(t *testing.T, handler func(net.Conn) error) (path string, done <-chan error) {
+	t.Helper()
+
+	path = filepath.Join(t.TempDir(), "smtp.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	result := make(chan error, 1)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			result <- acceptErr
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		result <- handler(conn)
+	}()
+	return path, result
+}
+
+// readSMTPData reads the message until the terminating dot
+func readSMTPData(reader *bufio.Reader) error {
+	for {
+		line, err := readSMTPCommand(reader)
+		if err != nil {
+			return err
+		}
+		if line == "." {
+			return nil
+		}
+	}
+}
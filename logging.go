@@ -0,0 +1,166 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// BodyLogMode sets how much of the message text is logged
+type BodyLogMode int
+
+// body log modes
+const (
+	BodyLogFull      BodyLogMode = iota // whole text, the default
+	BodyLogTruncated                    // first bodyLogTruncateLen bytes of the text
+	BodyLogOff                          // text size only
+)
+
+// bodyLogTruncateLen is the length of the text logged with BodyLogTruncated
+const bodyLogTruncateLen = 128
+
+// redacted replaces the credentials in the logged values
+const redacted = "[REDACTED]"
+
+// phases of the send, reported in the structured events
+const (
+	phasePrepare        = "prepare"
+	phaseCircuitBreaker = "circuit-breaker"
+	phaseRateLimit      = "rate-limit"
+	phaseConnect        = "connect"
+	phaseAuth           = "auth"
+	phaseMail           = "mail"
+	phaseRcpt           = "rcpt"
+	phaseData           = "data"
+)
+
+// phaseError tells the phase of the send the error happened at, its text is the one of the wrapped error
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e *phaseError) Error() string { return e.err.Error() }
+
+func (e *phaseError) Unwrap() error { return e.err }
+
+func withPhase(phase string, err error) error {
+	return &phaseError{phase: phase, err: err}
+}
+
+// eventLevel is the severity of the structured event
+type eventLevel int
+
+const (
+	eventInfo eventLevel = iota
+	eventError
+)
+
+// eventAttr is the key and value of the structured event attribute
+type eventAttr struct {
+	key   string
+	value interface{}
+}
+
+// eventLogger gets the structured events of the sends, implemented with log/slog by SlogLogger
+type eventLogger interface {
+	event(ctx context.Context, level eventLevel, msg string, attrs []eventAttr)
+}
+
+// loggedBody returns the text to log with Logf, quoted, according to the body log mode
+func (em *Sender) loggedBody(text string) string {
+	if em.bodyLog == BodyLogOff {
+		return "<" + strconv.Itoa(len(text)) + " bytes>"
+	}
+	body, truncated := em.bodyText(text)
+	if truncated {
+		return strconv.Quote(body) + "... (" + strconv.Itoa(len(text)) + " bytes)"
+	}
+	return strconv.Quote(body)
+}
+
+// bodyText returns the text cut to bodyLogTruncateLen for BodyLogTruncated, with credentials redacted
+func (em *Sender) bodyText(text string) (body string, truncated bool) {
+	if em.bodyLog == BodyLogTruncated && len(text) > bodyLogTruncateLen {
+		cut := bodyLogTruncateLen
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		return em.redact(text[:cut]), true
+	}
+	return em.redact(text), false
+}
+
+// redact replaces the SMTP and proxy passwords in the string
+func (em *Sender) redact(s string) string {
+	for _, secret := range []string{em.smtpPassword, em.proxy.password} {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// bodyAttrs returns the event attributes of the message text. The events are logged at info level,
+// so the body goes to them only if asked for with LogBody.
+func (em *Sender) bodyAttrs(text string) []eventAttr {
+	if !em.bodyLogSet || em.bodyLog == BodyLogOff {
+		return nil
+	}
+	body, truncated := em.bodyText(text)
+	if truncated {
+		return []eventAttr{{"body", body}, {"body_size", len(text)}}
+	}
+	return []eventAttr{{"body", body}}
+}
+
+// logDelivery reports the outcome of Deliver as a structured event with the body attributes, if events are logged
+func (em *Sender) logDelivery(ctx context.Context, params Params, body func() []eventAttr, msg []byte, res *Result,
+	err error, duration time.Duration) {
+	if em.events == nil {
+		return
+	}
+
+	_, addr := em.serverAddress()
+	attrs := []eventAttr{{"host", addr}, {"from", extractEmailAddress(params.From)}, {"recipients", len(params.To)}}
+	if id := messageID(msg); id != "" {
+		attrs = append(attrs, eventAttr{"message_id", id})
+	}
+	attrs = append(attrs, body()...)
+	attrs = append(attrs, eventAttr{"duration", duration})
+
+	if err == nil {
+		attrs = append(attrs, eventAttr{"relay", res.Relay})
+		em.events.event(ctx, eventInfo, "email sent", attrs)
+		return
+	}
+
+	var phErr *phaseError
+	if errors.As(err, &phErr) {
+		attrs = append(attrs, eventAttr{"phase", phErr.phase})
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		attrs = append(attrs, eventAttr{"smtp_code", protoErr.Code})
+	}
+	attrs = append(attrs, eventAttr{"error", em.redact(err.Error())})
+	em.events.event(ctx, eventError, "email send failed", attrs)
+}
+
+// messageID returns Message-ID header of the message, empty if it has none
+func messageID(msg []byte) string {
+	if len(msg) == 0 {
+		return ""
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	return header.Get("Message-ID")
+}
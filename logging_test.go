@@ -0,0 +1,71 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_loggedBody(t *testing.T) {
+	long := strings.Repeat("ы", bodyLogTruncateLen) // two bytes each, the cut falls on a rune start
+	tbl := []struct {
+		name string
+		mode BodyLogMode
+		text string
+		want string
+	}{
+		{"full", BodyLogFull, "some text\n", `"some text\n"`},
+		{"off", BodyLogOff, "some text\n", "<10 bytes>"},
+		{"truncated short", BodyLogTruncated, "some text\n", `"some text\n"`},
+		{"truncated long", BodyLogTruncated, long, `"` + strings.Repeat("ы", bodyLogTruncateLen/2) + `"... (256 bytes)`},
+		{"truncated mid-rune", BodyLogTruncated, "a" + long, `"a` + strings.Repeat("ы", bodyLogTruncateLen/2-1) + `"... (257 bytes)`},
+		{"redacted", BodyLogFull, "password is secret-pass", `"password is [REDACTED]"`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSender("localhost", LogBody(tt.mode), Auth("user", "secret-pass"))
+			assert.Equal(t, tt.want, s.loggedBody(tt.text))
+		})
+	}
+}
+
+func TestEmail_DeliverLogBody(t *testing.T) {
+	logBuff := bytes.NewBuffer(nil)
+	s := NewSender("localhost", SMTP(newTestSMTPClient()), LogBody(BodyLogOff), Log(newTestLogger(logBuff)))
+	_, err := s.Deliver(context.Background(), "confidential", Params{From: "from@example.com", To: []string{"to@example.com"}})
+	require.NoError(t, err)
+	assert.Contains(t, logBuff.String(), "[DEBUG] send <12 bytes> to [to@example.com]")
+	assert.NotContains(t, logBuff.String(), "confidential")
+}
+
+func TestEmail_DeliverPhase(t *testing.T) {
+	client := newTestSMTPClient()
+	client.RcptFunc = func(string) error { return &textproto.Error{Code: 550, Msg: "no such user"} }
+	s := NewSender("localhost", SMTP(client))
+
+	_, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com", To: []string{"to@example.com"}})
+	var phErr *phaseError
+	require.ErrorAs(t, err, &phErr)
+	assert.Equal(t, phaseRcpt, phErr.phase)
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr, "phase error unwraps")
+	assert.Equal(t, err.Error(), phErr.err.Error(), "phase error keeps the text")
+
+	_, err = s.Deliver(context.Background(), "test body", Params{From: "from@example.com"})
+	require.ErrorAs(t, err, &phErr)
+	assert.Equal(t, phasePrepare, phErr.phase)
+	assert.EqualError(t, err, "no recipients")
+	assert.False(t, errors.Is(err, context.Canceled))
+}
+
+func TestMessageID(t *testing.T) {
+	assert.Equal(t, "<123@example.com>", messageID([]byte("From: a@example.com\nMessage-ID: <123@example.com>\n\nbody")))
+	assert.Equal(t, "", messageID([]byte("From: a@example.com\n\nbody")))
+	assert.Equal(t, "", messageID(nil))
+}
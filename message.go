@@ -0,0 +1,70 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Envelope is the SMTP envelope of the message, the addresses given to MAIL FROM and RCPT TO
+type Envelope struct {
+	From string
+	To   []string
+}
+
+// Message is the built message along with its envelope
+type Message struct {
+	Envelope
+	Data []byte // RFC 5322 message with CRLF line endings, as sent after DATA, before dot-stuffing
+}
+
+// Reader returns the reader of the message data
+func (m *Message) Reader() io.Reader {
+	return bytes.NewReader(m.Data)
+}
+
+// WriteTo writes the message data to w, e.g. as .eml file
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m.Data)
+	return int64(n), err
+}
+
+// BuildMessage makes the message Send would send for the text and params, with its envelope.
+// AllowRecipients and RedirectAll apply to it, middlewares don't, as they wrap the send.
+func (em *Sender) BuildMessage(text string, params Params) (*Message, error) {
+	if len(params.To) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	params, err := em.applyStaging(params)
+	if err != nil {
+		return nil, err
+	}
+	buff, err := em.buildMessage(text, params)
+	if err != nil {
+		return nil, fmt.Errorf("can't make email message: %w", err)
+	}
+
+	res := &Message{Envelope: Envelope{From: extractEmailAddress(params.From), To: make([]string, 0, len(params.To))},
+		Data: toCRLF(buff.Bytes())}
+	for _, rcpt := range params.To {
+		res.To = append(res.To, extractEmailAddress(rcpt))
+	}
+	return res, nil
+}
+
+// toCRLF replaces bare LF and bare CR line endings with CRLF, keeping the existing CRLF ones
+func toCRLF(data []byte) []byte {
+	res := make([]byte, 0, len(data)+bytes.Count(data, []byte("\n")))
+	for i, b := range data {
+		switch {
+		case b == '\r' && (i == len(data)-1 || data[i+1] != '\n'):
+			res = append(res, '\r', '\n')
+		case b == '\n' && (i == 0 || data[i-1] != '\r'):
+			res = append(res, '\r', '\n')
+		default:
+			res = append(res, b)
+		}
+	}
+	return res
+}
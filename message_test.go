@@ -0,0 +1,58 @@
+package email
+
+import (
+	"bytes"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_BuildMessage(t *testing.T) {
+	s := NewSender("localhost", ContentType("text/html"))
+	s.timeNow = func() time.Time { return time.Date(2022, time.February, 10, 23, 33, 58, 0, time.UTC) }
+	s.randomID = func() string { return "0123456789abcdef" }
+
+	msg, err := s.BuildMessage("some text\n", Params{From: `"John Doe" <john@example.com>`,
+		To: []string{"to@example.com", "Two <two@example.com>"}, Subject: "subj"})
+	require.NoError(t, err)
+	assert.Equal(t, Envelope{From: "john@example.com", To: []string{"to@example.com", "two@example.com"}}, msg.Envelope)
+	assert.Equal(t, "From: \"John Doe\" <john@example.com>\r\nTo: to@example.com,Two <two@example.com>\r\nSubject: subj\r\n"+
+		"MIME-version: 1.0\r\nDate: Thu, 10 Feb 2022 23:33:58 +0000\r\nMessage-ID: <0123456789abcdef@example.com>\r\nContent-Transfer-Encoding: quoted-printable\r\n"+
+		"Content-Type: text/html; charset=\"UTF-8\"\r\n\r\nsome text\r\n", string(msg.Data))
+
+	parsed, err := mail.ReadMessage(msg.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, "subj", parsed.Header.Get("Subject"))
+
+	buff := bytes.NewBuffer(nil)
+	n, err := msg.WriteTo(buff)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(msg.Data)), n)
+	assert.Equal(t, msg.Data, buff.Bytes())
+}
+
+func TestEmail_BuildMessageErrors(t *testing.T) {
+	s := NewSender("localhost")
+	_, err := s.BuildMessage("text", Params{From: "from@example.com"})
+	require.EqualError(t, err, "no recipients")
+
+	_, err = s.BuildMessage("text", Params{From: "from@example.com", To: []string{"to@example.com"}, Attachments: []string{"testdata/no-such-file"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't make email message")
+
+	s = NewSender("localhost", RedirectAll("qa@example.com"))
+	msg, err := s.BuildMessage("text", Params{From: "from@example.com", To: []string{"to@example.com"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"qa@example.com"}, msg.To)
+	assert.Contains(t, string(msg.Data), "\r\nX-Original-To: to@example.com\r\n")
+}
+
+func TestToCRLF(t *testing.T) {
+	assert.Equal(t, "a\r\nb\r\n\r\nc", string(toCRLF([]byte("a\nb\r\n\nc"))))
+	assert.Equal(t, "\r\n", string(toCRLF([]byte("\n"))))
+	assert.Equal(t, "", string(toCRLF(nil)))
+	assert.Equal(t, "a\r\nb\r\n\r\nc\r\n", string(toCRLF([]byte("a\rb\r\r\nc\r"))), "bare CR")
+}
@@ -0,0 +1,54 @@
+package email
+
+import (
+	"context"
+	"time"
+)
+
+// Handler sends the message made of the text and params, Sender.Deliver is the last one in the chain
+type Handler func(ctx context.Context, text string, params Params) (*Result, error)
+
+// Middleware wraps the next handler. It can change the text and params passed to next, return without
+// calling next to stop the send, or look at the result next returns. The result can be nil even with no error,
+// if a middleware stopped the send that way.
+type Middleware func(next Handler) Handler
+
+// chain wraps the handler with the sender's middlewares, the first one is the outermost
+func (em *Sender) chain(h Handler) Handler {
+	for i := len(em.middlewares) - 1; i >= 0; i-- {
+		h = em.middlewares[i](h)
+	}
+	return h
+}
+
+// Footer is the middleware appending the footer to the text of each message
+func Footer(footer string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, text string, params Params) (*Result, error) {
+			return next(ctx, text+footer, params)
+		}
+	}
+}
+
+// AuditLog is the middleware logging each send at info level, with subject, sender, recipients, the relay
+// which accepted the message, or "-" if there is no result, duration and error. The text is not logged.
+func AuditLog(logger Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, text string, params Params) (*Result, error) {
+			start := time.Now()
+			res, err := next(ctx, text, params)
+			if err != nil {
+				logger.Logf("[INFO] audit: email %q from %s to %v failed in %v, %v", params.Subject, params.From, params.To,
+					time.Since(start), err)
+				return res, err
+			}
+			relay := "-"
+			if res != nil {
+				relay = res.Relay
+			}
+			logger.Logf("[INFO] audit: email %q from %s to %v sent through %s in %v", params.Subject, params.From, params.To,
+				relay, time.Since(start))
+			return res, nil
+		}
+	}
+}
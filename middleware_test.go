@@ -0,0 +1,123 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_Middlewares(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com", "blocked@example.com"}, Subject: "subj"}
+
+	t.Run("order and mutation", func(t *testing.T) {
+		client := newTestSMTPClient()
+		wc := &fakeWriterCloser{buff: bytes.NewBuffer(nil)}
+		client.DataFunc = func() (io.WriteCloser, error) { return wc, nil }
+
+		calls := []string{}
+		trace := func(name string) Middleware {
+			return func(next Handler) Handler {
+				return func(ctx context.Context, text string, params Params) (*Result, error) {
+					calls = append(calls, name+" before")
+					res, err := next(ctx, text, params)
+					calls = append(calls, name+" after")
+					return res, err
+				}
+			}
+		}
+		dropBlocked := func(next Handler) Handler {
+			return func(ctx context.Context, text string, params Params) (*Result, error) {
+				to := []string{}
+				for _, rcpt := range params.To {
+					if !strings.HasPrefix(rcpt, "blocked@") {
+						to = append(to, rcpt)
+					}
+				}
+				params.To = to
+				return next(ctx, text, params)
+			}
+		}
+
+		s := NewSender("localhost", SMTP(client), Middlewares(trace("first"), dropBlocked),
+			Middlewares(trace("second"), Footer("\n--\nfooter")))
+		res, err := s.Deliver(context.Background(), "some text", params)
+		require.NoError(t, err)
+		assert.Equal(t, []RecipientStatus{{Address: "to@example.com"}}, res.Recipients)
+		assert.Equal(t, []string{"first before", "second before", "second after", "first after"}, calls)
+		require.Len(t, client.RcptCalls(), 1)
+		assert.Contains(t, wc.buff.String(), "some text\r\n--\r\nfooter")
+	})
+
+	t.Run("extra header", func(t *testing.T) {
+		client := newTestSMTPClient()
+		wc := &fakeWriterCloser{buff: bytes.NewBuffer(nil)}
+		client.DataFunc = func() (io.WriteCloser, error) { return wc, nil }
+
+		tag := func(next Handler) Handler {
+			return func(ctx context.Context, text string, params Params) (*Result, error) {
+				headers := map[string]string{"X-Mailer-Tag": "newsletter"}
+				for name, value := range params.Headers {
+					headers[name] = value
+				}
+				params.Headers = headers // copied, the caller's map stays as is
+				return next(ctx, text, params)
+			}
+		}
+
+		s := NewSender("localhost", SMTP(client), Middlewares(tag))
+		p := params
+		p.Headers = map[string]string{"X-Campaign": "spring"}
+		_, err := s.Deliver(context.Background(), "some text", p)
+		require.NoError(t, err)
+		assert.Contains(t, wc.buff.String(), "\nX-Campaign: spring\nX-Mailer-Tag: newsletter\n")
+		assert.Equal(t, map[string]string{"X-Campaign": "spring"}, p.Headers)
+	})
+
+	t.Run("short-circuit", func(t *testing.T) {
+		client := newTestSMTPClient()
+		errBlocked := errors.New("blocked by policy")
+		block := func(Handler) Handler {
+			return func(context.Context, string, Params) (*Result, error) { return nil, errBlocked }
+		}
+		s := NewSender("localhost", SMTP(client), Middlewares(block))
+		err := s.Send("some text", params)
+		require.ErrorIs(t, err, errBlocked)
+		assert.Empty(t, client.MailCalls())
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}
+	logBuff := bytes.NewBuffer(nil)
+	audit := AuditLog(newTestLogger(logBuff))
+
+	s := NewSender("localhost", SMTP(newTestSMTPClient()), Middlewares(audit))
+	require.NoError(t, s.Send("secret text", params))
+	assert.Contains(t, logBuff.String(), `[INFO] audit: email "subj" from from@example.com to [to@example.com] sent through localhost:25 in `)
+
+	client := newTestSMTPClient()
+	client.MailFunc = func(string) error { return &textproto.Error{Code: 550, Msg: "rejected"} }
+	s = NewSender("localhost", SMTP(client), Middlewares(audit))
+	require.Error(t, s.Send("secret text", params))
+	assert.Contains(t, logBuff.String(), `[INFO] audit: email "subj" from from@example.com to [to@example.com] failed in `)
+	assert.Contains(t, logBuff.String(), "bad from address")
+	assert.NotContains(t, logBuff.String(), "secret text")
+
+	// the inner middleware drops the message with no result and no error
+	client = newTestSMTPClient()
+	drop := func(Handler) Handler {
+		return func(context.Context, string, Params) (*Result, error) { return nil, nil }
+	}
+	logBuff.Reset()
+	s = NewSender("localhost", SMTP(client), Middlewares(audit, drop))
+	require.NoError(t, s.Send("secret text", params))
+	assert.Contains(t, logBuff.String(), `[INFO] audit: email "subj" from from@example.com to [to@example.com] sent through - in `)
+	assert.Empty(t, client.MailCalls())
+}
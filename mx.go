@@ -0,0 +1,143 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Resolver looks up MX records of a domain, *net.Resolver implements it
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// deliverMX sends the message straight to the mail exchangers of the recipients' domains, a transaction per domain.
+// Recipients of the domain which failed get the error in the result, returned along with *RecipientsError.
+func (em *Sender) deliverMX(ctx context.Context, msg *payload, params Params) (*Result, error) {
+	domains, groups, err := groupByDomain(params.To)
+	if err != nil {
+		return nil, err
+	}
+
+	rcpts := make([][]string, 0, len(domains))
+	results := make([]*Result, 0, len(domains))
+	errs := make([]error, 0, len(domains))
+	for _, domain := range domains {
+		p := params
+		p.To = groups[domain]
+		res, e := em.deliverDomain(ctx, domain, msg, p)
+		if len(domains) == 1 {
+			return res, e
+		}
+		rcpts, results, errs = append(rcpts, p.To), append(results, res), append(errs, e)
+		if ctx.Err() != nil {
+			break // the rest of domains would fail the same way
+		}
+	}
+	return mergeResults(rcpts, results, errs)
+}
+
+// deliverDomain tries the mail exchangers of the domain in preference order, the next one on a connection
+// failure or 4xx reply. Domain with no MX records is the exchanger itself, RFC 5321 section 5.1.
+func (em *Sender) deliverDomain(ctx context.Context, domain string, msg *payload, params Params) (*Result, error) {
+	hosts, err := em.lookupMX(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, host := range hosts {
+		mx := *em // the same settings, including dial and STARTTLS, for the exchanger host
+		mx.host, mx.smtpClient, mx.mxResolver, mx.relays = host, nil, nil, nil
+		res, e := mx.transfer(ctx, msg, params)
+		if e == nil {
+			em.logger.Logf("[INFO] email to %v delivered through mx %s", params.To, res.Relay)
+			return res, nil
+		}
+		if ctx.Err() != nil || !temporaryFailure(e) {
+			return res, e
+		}
+		em.logger.Logf("[WARN] mx %s of %s failed, %v", host, domain, e)
+		lastErr = e
+	}
+	return nil, fmt.Errorf("all %d mx of %s failed, last error: %w", len(hosts), domain, lastErr)
+}
+
+// lookupMX returns the mail exchanger hosts of the domain, in preference order
+func (em *Sender) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	domain, err := toASCIIDomain(domain) // DNS has internationalized domains in punycode only
+	if err != nil {
+		return nil, err
+	}
+	records, err := em.mxResolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, fmt.Errorf("failed to lookup mx of %s: %w", domain, err)
+	}
+	if len(records) == 0 { // implicit MX, the domain's A/AAAA records are used
+		em.logger.Logf("[DEBUG] no mx records for %s, delivering to the domain itself", domain)
+		return []string{domain}, nil
+	}
+	if len(records) == 1 && strings.TrimSuffix(records[0].Host, ".") == "" {
+		return nil, fmt.Errorf("domain %s doesn't accept email, null mx", domain) // RFC 7505
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, r := range records {
+		hosts = append(hosts, strings.TrimSuffix(r.Host, "."))
+	}
+	return hosts, nil
+}
+
+// groupByDomain groups recipients by their lower-cased domain, the domains are in the order of appearance
+func groupByDomain(recipients []string) (domains []string, groups map[string][]string, err error) {
+	groups = map[string][]string{}
+	for _, rcpt := range recipients {
+		addr := extractEmailAddress(rcpt)
+		at := strings.LastIndex(addr, "@")
+		if at < 0 || at == len(addr)-1 {
+			return nil, nil, fmt.Errorf("no domain in recipient address %q", rcpt)
+		}
+		domain := strings.ToLower(addr[at+1:])
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], rcpt)
+	}
+	return domains, groups, nil
+}
+
+// mergeResults combines the results of transactions made for the parts of recipients, rcpts[i] is the part of i-th one.
+// Recipients of the failed transactions get its error, and the result goes along with *RecipientsError then.
+// Relays of the successful transactions are listed in the merged result, comma separated.
+func mergeResults(rcpts [][]string, results []*Result, errs []error) (*Result, error) {
+	res := &Result{}
+	relays := []string{}
+	var failed bool
+	for i, r := range results {
+		if errs[i] == nil {
+			res.Recipients = append(res.Recipients, r.Recipients...)
+			if r.Relay != "" {
+				relays = append(relays, r.Relay)
+			}
+			continue
+		}
+		failed = true
+		if r != nil && len(r.Recipients) > 0 { // rejected for some recipients, statuses are in the result
+			res.Recipients = append(res.Recipients, r.Recipients...)
+			continue
+		}
+		for _, rcpt := range rcpts[i] {
+			res.Recipients = append(res.Recipients, RecipientStatus{Address: extractEmailAddress(rcpt), Err: errs[i]})
+		}
+	}
+	res.Relay = strings.Join(relays, ", ")
+	if failed {
+		return res, &RecipientsError{Recipients: res.Recipients}
+	}
+	return res, nil
+}
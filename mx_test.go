@@ -0,0 +1,193 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_DeliverDirectMX(t *testing.T) {
+	params := Params{From: "from@example.com", Subject: "subj",
+		To: []string{"a@example.org", "b@mail.example.net", "c@Example.org"}}
+	resolver := mxTestResolver{
+		"example.org":      {{Host: "mx2.example.org.", Pref: 20}, {Host: "mx1.example.org.", Pref: 10}},
+		"mail.example.net": nil, // no MX, delivered to the domain itself
+	}
+
+	t.Run("mx in preference order, next on 4xx", func(t *testing.T) {
+		servers := newMXTestServers(map[string]string{"mx1.example.org:25": "421 busy", "mx2.example.org:25": "250 ok", "mail.example.net:25": "250 ok"})
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("ignored.example.com", DirectMX(resolver), DialContext(servers.dial()), Log(newTestLogger(logBuff)))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, "mx2.example.org:25, mail.example.net:25", res.Relay)
+		assert.Equal(t, []RecipientStatus{{Address: "a@example.org"}, {Address: "c@Example.org"},
+			{Address: "b@mail.example.net"}}, res.Recipients)
+		assert.Equal(t, []string{"mx1.example.org:25", "mx2.example.org:25", "mail.example.net:25"}, servers.dialed())
+		assert.Equal(t, []string{"RCPT TO:<a@example.org>", "RCPT TO:<c@Example.org>"}, servers.rcpts("mx2.example.org:25"))
+		assert.Equal(t, []string{"RCPT TO:<b@mail.example.net>"}, servers.rcpts("mail.example.net:25"))
+		assert.Contains(t, logBuff.String(), "[WARN] mx mx1.example.org of example.org failed")
+		assert.Contains(t, logBuff.String(), "[DEBUG] no mx records for mail.example.net")
+	})
+
+	t.Run("one domain failed", func(t *testing.T) {
+		servers := newMXTestServers(map[string]string{"mx1.example.org:25": "550 no relay", "mail.example.net:25": "250 ok"})
+		s := NewSender("ignored.example.com", DirectMX(resolver), DialContext(servers.dial()))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.Error(t, err)
+		var rcptErr *RecipientsError
+		require.ErrorAs(t, err, &rcptErr)
+		assert.Contains(t, err.Error(), "rejected for 2 of 3 recipients")
+		require.NotNil(t, res)
+		assert.Equal(t, "mail.example.net:25", res.Relay)
+		require.Len(t, res.Recipients, 3)
+		assert.Error(t, res.Recipients[0].Err)
+		assert.Error(t, res.Recipients[1].Err)
+		assert.NoError(t, res.Recipients[2].Err)
+		assert.Equal(t, []string{"mx1.example.org:25", "mail.example.net:25"}, servers.dialed(), "5xx is not retried")
+	})
+
+	t.Run("single domain error as is", func(t *testing.T) {
+		s := NewSender("ignored.example.com", DirectMX(mxTestResolver{"example.com": {{Host: ".", Pref: 0}}}))
+		_, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com", To: []string{"to@example.com"}})
+		require.EqualError(t, err, "domain example.com doesn't accept email, null mx")
+	})
+
+	t.Run("lookup failed", func(t *testing.T) {
+		s := NewSender("ignored.example.com", DirectMX(mxTestResolver{}))
+		_, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com", To: []string{"to@fail.example.com"}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to lookup mx of fail.example.com: lookup fail.example.com: server misbehaving")
+	})
+
+	t.Run("no domain", func(t *testing.T) {
+		s := NewSender("ignored.example.com", DirectMX(resolver))
+		err := s.SendRaw(context.Background(), "from@example.com", []string{"local"}, strings.NewReader("Subject: raw\n\nbody"))
+		require.EqualError(t, err, `no domain in recipient address "local"`, "built messages have the addresses checked earlier")
+	})
+}
+
+func TestEmail_lookupMX(t *testing.T) {
+	s := NewSender("ignored.example.com", DirectMX(mxTestResolver{
+		"example.com": {{Host: "b.example.com.", Pref: 10}, {Host: "c.example.com.", Pref: 20}, {Host: "a.example.com.", Pref: 10}},
+	}))
+
+	hosts, err := s.lookupMX(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b.example.com", "a.example.com", "c.example.com"}, hosts)
+
+	hosts, err = s.lookupMX(context.Background(), "nx.example.com")
+	require.NoError(t, err, "not found is no MX")
+	assert.Equal(t, []string{"nx.example.com"}, hosts)
+}
+
+// mxTestResolver returns MX records by domain, not found for unknown ones and an error for "fail." domains
+type mxTestResolver map[string][]*net.MX
+
+func (r mxTestResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if strings.HasPrefix(name, "fail.") {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// mxTestServers are in-memory servers replying to MAIL FROM with the reply by address, they record commands they get
+type mxTestServers struct {
+	mailReplies map[string]string
+
+	mu       sync.Mutex
+	dialedTo []string
+	commands map[string][]string
+}
+
+func newMXTestServers(mailReplies map[string]string) *mxTestServers {
+	return &mxTestServers{mailReplies: mailReplies, commands: map[string][]string{}}
+}
+
+func (m *mxTestServers) dialed() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dialedTo
+}
+
+func (m *mxTestServers) rcpts(addr string) (res []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cmd := range m.commands[addr] {
+		if strings.HasPrefix(cmd, "RCPT") {
+			res = append(res, cmd)
+		}
+	}
+	return res
+}
+
+// dial connects to the in-memory server of the address, unknown addresses are refused
+func (m *mxTestServers) dial() DialContextFunc {
+	return func(_ context.Context, _, address string) (net.Conn, error) {
+		m.mu.Lock()
+		m.dialedTo = append(m.dialedTo, address)
+		m.mu.Unlock()
+		mailReply, ok := m.mailReplies[address]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			_ = server.SetDeadline(time.Now().Add(3 * time.Second))
+			_ = mxTestSession(server, mailReply, func(cmd string) { // the client drops failed sessions, errors are expected
+				m.mu.Lock()
+				m.commands[address] = append(m.commands[address], cmd)
+				m.mu.Unlock()
+			})
+		}()
+		return client, nil
+	}
+}
+
+// mxTestSession serves a single transaction, failing it with mailReply unless it's 250
+func mxTestSession(conn net.Conn, mailReply string, record func(string)) error {
+	reader := bufio.NewReader(conn)
+	if err := writeSMTPResponse(conn, "220 mx.example.net ESMTP ready"); err != nil {
+		return err
+	}
+	for {
+		cmd, err := readSMTPCommand(reader)
+		if err != nil {
+			return err
+		}
+		record(cmd)
+		reply := "250 ok"
+		switch {
+		case strings.HasPrefix(cmd, "MAIL"):
+			reply = mailReply
+		case cmd == "DATA":
+			if err = writeSMTPResponse(conn, "354 go ahead"); err != nil {
+				return err
+			}
+			if err = readSMTPData(reader); err != nil {
+				return err
+			}
+		case cmd == "QUIT":
+			return writeSMTPResponse(conn, "221 bye")
+		}
+		if err = writeSMTPResponse(conn, reply); err != nil {
+			return err
+		}
+	}
+}
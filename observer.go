@@ -0,0 +1,132 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// Phase is the step of the SMTP transaction reported to the Observer
+type Phase string
+
+// phases reported to the Observer
+const (
+	PhaseDial Phase = "dial" // connection to the server, or the proxy, without TLS handshake
+	PhaseTLS  Phase = "tls"  // TLS handshake, implicit or after STARTTLS
+	PhaseAuth Phase = "auth"
+	PhaseMail Phase = "mail"
+	PhaseRcpt Phase = "rcpt" // reported for each recipient
+	PhaseData Phase = "data" // DATA command, the message and the reply to it
+	PhaseQuit Phase = "quit"
+)
+
+// ErrorClass is the kind of the phase failure, to be used as a metric label
+type ErrorClass string
+
+// error classes of the phase failures
+const (
+	ErrorClassNone      ErrorClass = ""
+	ErrorClassCanceled  ErrorClass = "canceled"
+	ErrorClassTimeout   ErrorClass = "timeout"
+	ErrorClassNetwork   ErrorClass = "network"
+	ErrorClassTLS       ErrorClass = "tls"
+	ErrorClassTemporary ErrorClass = "temporary" // 4xx reply
+	ErrorClassPermanent ErrorClass = "permanent" // 5xx reply
+	ErrorClassOther     ErrorClass = "other"
+)
+
+// PhaseEvent is the outcome of the phase
+type PhaseEvent struct {
+	Phase    Phase
+	Server   string // host:port or socket path
+	Start    time.Time
+	Duration time.Duration
+	Err      error      // nil on success
+	Class    ErrorClass // ErrorClassNone on success
+	Code     int        // SMTP reply code of the failure, zero if there is none
+}
+
+// Observer gets the outcome of each phase of the sends, an adapter to metrics or tracing library implements it.
+// It's called synchronously from the sending goroutine, so it should be fast, and concurrently for concurrent sends.
+type Observer interface {
+	ObservePhase(ctx context.Context, event PhaseEvent)
+}
+
+// observe reports the phase started at start to the observer, if set
+func (em *Sender) observe(ctx context.Context, phase Phase, start time.Time, err error) {
+	if em.observer == nil {
+		return
+	}
+	_, addr := em.serverAddress()
+	event := PhaseEvent{Phase: phase, Server: addr, Start: start, Duration: time.Since(start), Err: err}
+	if err != nil {
+		event.Class, event.Code = classifyError(phase, err)
+	}
+	em.observer.ObservePhase(ctx, event)
+}
+
+// classifyError returns the class of the phase error, and the SMTP reply code if it's a reply
+func classifyError(phase Phase, err error) (ErrorClass, int) {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		switch {
+		case protoErr.Code >= 400 && protoErr.Code < 500:
+			return ErrorClassTemporary, protoErr.Code
+		case protoErr.Code >= 500:
+			return ErrorClassPermanent, protoErr.Code
+		}
+		return ErrorClassOther, protoErr.Code
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCanceled, 0
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout, 0
+	}
+	var recordErr tls.RecordHeaderError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if phase == PhaseTLS || errors.As(err, &recordErr) || errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return ErrorClassTLS, 0
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || phase == PhaseDial {
+		return ErrorClassNetwork, 0
+	}
+	return ErrorClassOther, 0
+}
+
+// ExpvarObserver counts the phases in expvar map: "<phase>.count", "<phase>.errors", "<phase>.errors.<class>"
+// and "<phase>.seconds", the total duration.
+type ExpvarObserver struct {
+	vars *expvar.Map
+}
+
+// NewExpvarObserver makes the observer publishing its map under the name, it panics if the name is in use already
+func NewExpvarObserver(name string) *ExpvarObserver {
+	return &ExpvarObserver{vars: expvar.NewMap(name)}
+}
+
+// ObservePhase counts the phase
+func (o *ExpvarObserver) ObservePhase(_ context.Context, event PhaseEvent) {
+	prefix := string(event.Phase)
+	o.vars.Add(prefix+".count", 1)
+	o.vars.AddFloat(prefix+".seconds", event.Duration.Seconds())
+	if event.Err != nil {
+		o.vars.Add(prefix+".errors", 1)
+		o.vars.Add(prefix+".errors."+string(event.Class), 1)
+	}
+}
+
+// Vars returns the published map
+func (o *ExpvarObserver) Vars() *expvar.Map {
+	return o.vars
+}
@@ -0,0 +1,124 @@
+package email
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_Observe(t *testing.T) {
+	host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+		{"EHLO localhost", "250-smtp.example.net\r\n250 AUTH PLAIN"},
+		{"AUTH PLAIN ", "235 accepted"},
+		{"MAIL FROM:<from@example.com>", "250 ok"},
+		{"RCPT TO:<to1@example.com>", "250 ok"},
+		{"RCPT TO:<to2@example.com>", "452 too many recipients"},
+	}))
+
+	obs := &observerTestRecorder{}
+	s := NewSender(host, Port(port), Auth("user", "pass"), Observe(obs))
+	err := s.Send("test body", Params{From: "from@example.com", To: []string{"to1@example.com", "to2@example.com"}})
+	waitSMTPTestServer(t, done)
+	require.Error(t, err)
+
+	events := obs.get()
+	require.Len(t, events, 5)
+	for i, phase := range []Phase{PhaseDial, PhaseAuth, PhaseMail, PhaseRcpt, PhaseRcpt} {
+		assert.Equal(t, phase, events[i].Phase)
+		assert.Equal(t, fmt.Sprintf("%s:%d", host, port), events[i].Server)
+		assert.False(t, events[i].Start.IsZero())
+	}
+	assert.NoError(t, events[3].Err)
+	assert.Equal(t, ErrorClassNone, events[3].Class)
+	assert.Error(t, events[4].Err)
+	assert.Equal(t, ErrorClassTemporary, events[4].Class)
+	assert.Equal(t, 452, events[4].Code)
+}
+
+func TestEmail_ObserveSMTPClient(t *testing.T) {
+	obs := &observerTestRecorder{}
+	s := NewSender("localhost", SMTP(newTestSMTPClient()), Observe(obs))
+	require.NoError(t, s.Send("test body", Params{From: "from@example.com", To: []string{"to@example.com"}}))
+
+	phases := []Phase{}
+	for _, e := range obs.get() {
+		phases = append(phases, e.Phase)
+		assert.NoError(t, e.Err)
+	}
+	assert.Equal(t, []Phase{PhaseMail, PhaseRcpt, PhaseData, PhaseQuit}, phases)
+}
+
+func TestClassifyError(t *testing.T) {
+	tbl := []struct {
+		phase Phase
+		err   error
+		class ErrorClass
+		code  int
+	}{
+		{PhaseMail, &textproto.Error{Code: 421, Msg: "closing"}, ErrorClassTemporary, 421},
+		{PhaseRcpt, fmt.Errorf("bad to: %w", &textproto.Error{Code: 550, Msg: "no user"}), ErrorClassPermanent, 550},
+		{PhaseDial, fmt.Errorf("dial: %w", context.Canceled), ErrorClassCanceled, 0},
+		{PhaseDial, context.DeadlineExceeded, ErrorClassTimeout, 0},
+		{PhaseData, os.ErrDeadlineExceeded, ErrorClassTimeout, 0},
+		{PhaseDial, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorClassNetwork, 0},
+		{PhaseDial, errors.New("socks5 failed"), ErrorClassNetwork, 0},
+		{PhaseTLS, errors.New("handshake failure"), ErrorClassTLS, 0},
+		{PhaseDial, fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}), ErrorClassTLS, 0},
+		{PhaseAuth, errors.New("unencrypted connection"), ErrorClassOther, 0},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			class, code := classifyError(tt.phase, tt.err)
+			assert.Equal(t, tt.class, class)
+			assert.Equal(t, tt.code, code)
+		})
+	}
+}
+
+func TestExpvarObserver(t *testing.T) {
+	o := &ExpvarObserver{vars: new(expvar.Map).Init()} // not published, the test can run again in the same process
+	o.ObservePhase(context.Background(), PhaseEvent{Phase: PhaseDial, Duration: 1500 * time.Millisecond})
+	o.ObservePhase(context.Background(), PhaseEvent{Phase: PhaseDial, Duration: 500 * time.Millisecond,
+		Err: context.DeadlineExceeded, Class: ErrorClassTimeout})
+	o.ObservePhase(context.Background(), PhaseEvent{Phase: PhaseRcpt, Err: errors.New("rejected"), Class: ErrorClassPermanent})
+
+	vars := o.Vars()
+	assert.Equal(t, "2", vars.Get("dial.count").String())
+	assert.Equal(t, "2", vars.Get("dial.seconds").String())
+	assert.Equal(t, "1", vars.Get("dial.errors").String())
+	assert.Equal(t, "1", vars.Get("dial.errors.timeout").String())
+	assert.Equal(t, "1", vars.Get("rcpt.errors.permanent").String())
+	assert.Nil(t, vars.Get("mail.count"))
+
+	name := fmt.Sprintf("email_test_observer_%d", time.Now().UnixNano()) // expvar names can't be published twice
+	published := NewExpvarObserver(name)
+	assert.Same(t, published.Vars(), expvar.Get(name))
+}
+
+type observerTestRecorder struct {
+	mu     sync.Mutex
+	events []PhaseEvent
+}
+
+func (r *observerTestRecorder) ObservePhase(_ context.Context, event PhaseEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *observerTestRecorder) get() []PhaseEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events
+}
@@ -1,6 +1,12 @@
 package email
 
-import "time"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+)
 
 // Option func type
 type Option func(s *Sender)
@@ -47,10 +53,22 @@ func TLS(enabled bool) Option {
 	}
 }
 
-// STARTTLS enables STARTTLS support
+// STARTTLS enables STARTTLS support, enabled it is STARTTLSPolicy(StartTLSRequired), disabled StartTLSNever
 func STARTTLS(enabled bool) Option {
 	return func(s *Sender) {
-		s.starttls = enabled
+		s.starttls = StartTLSNever
+		if enabled {
+			s.starttls = StartTLSRequired
+		}
+	}
+}
+
+// STARTTLSPolicy sets when the connection is upgraded with STARTTLS. StartTLSOpportunistic upgrades
+// if the server advertises STARTTLS, StartTLSRequired fails before AUTH and MAIL if it doesn't.
+// The policy has no effect with TLS, such a connection is encrypted from the start.
+func STARTTLSPolicy(policy StartTLSPolicy) Option {
+	return func(s *Sender) {
+		s.starttls = policy
 	}
 }
 
@@ -61,6 +79,280 @@ func InsecureSkipVerify(enabled bool) Option {
 	}
 }
 
+// ClientCertificate sets the client certificate and key PEM files presented to the server,
+// for both TLS and STARTTLS. The files are read on each connection.
+func ClientCertificate(certFile, keyFile string) Option {
+	return func(s *Sender) {
+		s.clientCertFile = certFile
+		s.clientKeyFile = keyFile
+	}
+}
+
+// GetClientCertificate sets the callback providing the client certificate on the server's request,
+// see tls.Config.GetClientCertificate. It takes precedence over ClientCertificate.
+func GetClientCertificate(fn func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) Option {
+	return func(s *Sender) {
+		s.getClientCert = fn
+	}
+}
+
+// RootCAs sets the root certificates the server certificate is verified with, instead of the system ones
+func RootCAs(pool *x509.CertPool) Option {
+	return func(s *Sender) {
+		s.rootCAs = pool
+	}
+}
+
+// TLSConfig sets the base TLS configuration for both TLS and STARTTLS, e.g. to require TLS 1.3,
+// restrict cipher suites or verify the server by a name other than the host, like when connecting by IP.
+// The config is cloned for each connection and never modified. Empty ServerName defaults to the host,
+// zero MinVersion to TLS 1.2; InsecureSkipVerify, RootCAs, client certificate and pin options apply on top of it.
+func TLSConfig(conf *tls.Config) Option {
+	return func(s *Sender) {
+		s.customTLS = conf
+	}
+}
+
+// PinSPKI accepts the server only if its certificate chain has a public key with one of the given hashes,
+// base64 encoded SHA-256 of the certificate's SubjectPublicKeyInfo, optionally prefixed with "sha256/".
+// The hash can be made with: openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64.
+// Pinning applies on top of the usual verification, matching any certificate of the verified chain,
+// and on its own if InsecureSkipVerify set, matching the server's own certificate only.
+func PinSPKI(hashes ...string) Option {
+	return func(s *Sender) {
+		s.tlsPins = hashes
+	}
+}
+
+// DialContext sets the function making connections to the server, e.g. to go through a custom proxy or tunnel.
+// The connection setup is still limited by TimeOut, and TLS option makes the handshake over the returned connection.
+// SourceAddr has no effect with a custom function, the proxy set with SOCKS5Proxy or HTTPProxy is reached with it.
+func DialContext(fn DialContextFunc) Option {
+	return func(s *Sender) {
+		s.dialContext = fn
+	}
+}
+
+// SourceAddr sets the local IP address connections are made from, e.g. on a multi-homed host
+// to send from the address SPF allows
+func SourceAddr(ip string) Option {
+	return func(s *Sender) {
+		s.sourceAddr = ip
+	}
+}
+
+// SOCKS5Proxy sets SOCKS5 proxy, as host:port, the connections to the server go through.
+// User and password are optional, empty user means no proxy authentication.
+func SOCKS5Proxy(address, user, password string) Option {
+	return func(s *Sender) {
+		s.proxy = proxyConfig{scheme: proxySOCKS5, address: address, user: user, password: password}
+	}
+}
+
+// HTTPProxy sets HTTP proxy, as host:port, the connections to the server are tunneled through with CONNECT method.
+// User and password are optional, empty user means no proxy authentication.
+func HTTPProxy(address, user, password string) Option {
+	return func(s *Sender) {
+		s.proxy = proxyConfig{scheme: proxyHTTP, address: address, user: user, password: password}
+	}
+}
+
+// UnixSocket sets the unix socket path the server listens on, e.g. of a local Postfix or Dovecot,
+// to connect to instead of host and port. The host is still used as the server name, for auth and TLS.
+func UnixSocket(path string) Option {
+	return func(s *Sender) {
+		s.unixSocket = path
+	}
+}
+
+// LMTP enables LMTP, RFC 2033, instead of SMTP: the client greets with LHLO and the server accepts or rejects
+// the message for each recipient after DATA, Deliver reports these per-recipient results.
+// STARTTLS isn't supported with LMTP, which is used over local connections, TLS is.
+func LMTP(enabled bool) Option {
+	return func(s *Sender) {
+		s.lmtp = enabled
+	}
+}
+
+// Failover sets the relays tried in order if the sender's own server fails with a connection error or 4xx reply.
+// Each relay is a sender made with NewSender and has its own host, port, TLS and auth settings, the message
+// is built by this sender. A failed relay is moved to the end of the list for coolDown, and Result.Relay
+// reports the one which accepted the message. DryRun, RateLimit and CircuitBreaker of a relay apply to it,
+// and the relay refusing the send with them is skipped.
+func Failover(coolDown time.Duration, relays ...*Sender) Option {
+	return func(s *Sender) {
+		s.relays = relays
+		s.relayCoolDown = coolDown
+		s.relayState = &relayState{failedUntil: map[*Sender]time.Time{}}
+	}
+}
+
+// DirectMX makes the sender deliver straight to the mail exchangers of the recipients' domains, instead of
+// the host. Recipients are grouped by domain, a transaction per domain, and the MX hosts are tried in
+// preference order, falling back to the domain's A/AAAA records if it has no MX. Port, dial, TLS and STARTTLS
+// settings apply to each exchanger, STARTTLSPolicy(StartTLSOpportunistic) is the usual choice. Failover relays
+// are not used. The resolver is net.DefaultResolver if nil.
+func DirectMX(resolver Resolver) Option {
+	return func(s *Sender) {
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		s.mxResolver = resolver
+	}
+}
+
+// Route sends the recipients matching the pattern through the transport, a sender made with NewSender with its own
+// host, credentials and other settings, the message is built by this sender. The pattern is matched against the
+// domain, like "example.com" or "*.example.com", or against the whole address if it has "@", like "*@example.com",
+// with path.Match syntax, case-insensitive. Routes are checked in the order added, the first match wins, and the
+// recipients matching none go through this sender. Mixed recipients are sent in a transaction per route.
+// DryRun, RateLimit and CircuitBreaker of the transport apply to the recipients routed to it.
+func Route(pattern string, transport *Sender) Option {
+	return func(s *Sender) {
+		s.routes = append(s.routes, route{pattern: strings.ToLower(pattern), transport: transport})
+	}
+}
+
+// RateLimit limits the messages sent to perSecond, with up to burst of them at once, token bucket style.
+// Send waits for the limit, as long as the context allows, unless RateLimitFailFast is set. Zero perSecond is no limit.
+func RateLimit(perSecond float64, burst int) Option {
+	return func(s *Sender) {
+		if perSecond <= 0 {
+			return
+		}
+		s.limiter().global = newTokenBucket(perSecond, burst, s.timeNow())
+	}
+}
+
+// DomainRateLimit limits the messages sent to each recipient domain to perSecond, with up to burst of them at once.
+// A message to several domains takes from the limit of each of them. Zero perSecond is no limit.
+func DomainRateLimit(perSecond float64, burst int) Option {
+	return func(s *Sender) {
+		if perSecond <= 0 {
+			return
+		}
+		l := s.limiter()
+		l.domainRate, l.domainBurst, l.domains = perSecond, burst, map[string]*tokenBucket{}
+	}
+}
+
+// RateLimitFailFast makes Send fail with *RateLimitError instead of waiting if the rate limit is exceeded
+func RateLimitFailFast(enabled bool) Option {
+	return func(s *Sender) {
+		s.limiter().failFast = enabled
+	}
+}
+
+// CircuitBreaker makes Send fail fast with *CircuitOpenError for coolDown after threshold consecutive connection
+// failures or 4xx replies, instead of waiting for the dial timeout each time the server is down. After coolDown
+// a single probe send goes to the server, its success closes the circuit and failure opens it again.
+// The breaker is checked before the message is built, so nothing is done for the send while it's open.
+// State changes are logged. Zero threshold is no breaker.
+func CircuitBreaker(threshold int, coolDown time.Duration) Option {
+	return func(s *Sender) {
+		if threshold <= 0 {
+			s.breaker = nil
+			return
+		}
+		s.breaker = &circuitBreaker{threshold: threshold, coolDown: coolDown}
+	}
+}
+
+// LogBody sets how much of the message text is logged, BodyLogFull, BodyLogTruncated or BodyLogOff.
+// The full text is logged by default, at debug level. The structured events of SlogLogger get the body
+// only with the mode set explicitly, as they are logged at info level.
+func LogBody(mode BodyLogMode) Option {
+	return func(s *Sender) {
+		s.bodyLog = mode
+		s.bodyLogSet = true
+	}
+}
+
+// Transcript records the SMTP conversation of each transaction, TranscriptToLog logs it at debug level and
+// TranscriptToError attaches it to the returned error as *TranscriptError, the modes can be combined.
+// AUTH credentials are redacted, message data is summarised with its size. With STARTTLS the connection
+// is upgraded under the recorder, so the encrypted part of the conversation is recorded as well.
+// Nothing is recorded for a client set with SMTP.
+func Transcript(mode TranscriptMode) Option {
+	return func(s *Sender) {
+		s.transcript = mode
+	}
+}
+
+// Observe sets the observer getting the outcome of each phase of the sends: dial, TLS handshake, auth, MAIL,
+// RCPT, DATA and QUIT, with the duration and the error class, for metrics and tracing.
+// NewExpvarObserver makes the one publishing the counters with expvar.
+func Observe(o Observer) Option {
+	return func(s *Sender) {
+		s.observer = o
+	}
+}
+
+// Middlewares adds the middlewares wrapping each send, in order: the first one added is the outermost,
+// it gets the text and params first and the result last. Footer and AuditLog are the built-in ones.
+func Middlewares(middlewares ...Middleware) Option {
+	return func(s *Sender) {
+		s.middlewares = append(s.middlewares, middlewares...)
+	}
+}
+
+// AllowRecipients restricts the delivery to the recipients matching the patterns, like Route does: a domain,
+// like "example.com" or "*.example.com", or an address, like "qa@example.com" or "qa+*@example.com".
+// Other recipients are dropped, or the send fails with reject set. Meant for staging environments.
+func AllowRecipients(reject bool, patterns ...string) Option {
+	return func(s *Sender) {
+		for _, p := range patterns {
+			s.staging.allowed = append(s.staging.allowed, route{pattern: strings.ToLower(p)})
+		}
+		s.staging.reject = reject
+	}
+}
+
+// RedirectAll sends all the messages to the address instead of their recipients, both in the envelope
+// and in To header. The original recipients are kept in X-Original-To header. Meant for staging environments.
+func RedirectAll(address string) Option {
+	return func(s *Sender) {
+		s.staging.redirectTo = address
+	}
+}
+
+// DryRun makes the sender build and check messages without connecting to the server. The checks which need no server
+// are made: addresses, TLS settings, including client certificate and pins, and auth against the TLS policy.
+// Send returns the result it would have with the message accepted, Result.Relay lists the servers of the routes
+// the recipients would go through, DirectMX exchangers excluded.
+func DryRun(enabled bool) Option {
+	return func(s *Sender) {
+		s.dryRunMode = enabled
+	}
+}
+
+// Streaming makes the sender encode the attachments and inline images while sending, instead of building the whole
+// message in memory first, so the memory used stays flat regardless of the file sizes. The headers are built and
+// all the files are opened before the connection is made, so a missing file fails the send before it starts.
+// The files are read again for each transaction, e.g. by a failover relay, and shouldn't change during the send.
+func Streaming(enabled bool) Option {
+	return func(s *Sender) {
+		s.streaming = enabled
+	}
+}
+
+// MaxMessageSize limits the size of the message, in bytes with the files encoded, checked before the files are encoded
+// and the connection is made. Message larger than the server advertises with SIZE extension fails before MAIL FROM
+// regardless of this limit. Exceeding either fails the send with *SizeLimitError.
+func MaxMessageSize(size int64) Option {
+	return func(s *Sender) {
+		s.maxMessageSize = size
+	}
+}
+
+// MaxAttachmentSize limits the size of each attachment and inline image, in bytes of the file. A larger file fails
+// the send with *SizeLimitError before anything is encoded.
+func MaxAttachmentSize(size int64) Option {
+	return func(s *Sender) {
+		s.maxAttachmentSize = size
+	}
+}
+
 // HELOHost sets the SMTP HELO/EHLO hostname for connections created by Sender.
 // Unset, the greeting stays net/smtp's "localhost". The value is passed to the server as-is,
 // so an address literal like "[192.0.2.10]" works, and it has no effect on a client
@@ -86,6 +378,30 @@ func LoginAuth() Option {
 	}
 }
 
+// ExternalAuth sets EXTERNAL auth method, the server authenticates the sender by the TLS client certificate
+// set with ClientCertificate or GetClientCertificate, and no username and password are needed.
+// Identity is the optional authorization identity, empty to act as the certificate's subject.
+func ExternalAuth(identity string) Option {
+	return func(s *Sender) {
+		s.authMethod = authMethodExternal
+		s.authIdentity = identity
+	}
+}
+
+// AutoAuth picks the auth mechanism from the ones advertised by the server in the AUTH extension,
+// after the greeting and STARTTLS. The first of preferred mechanisms offered by the server is used,
+// with no preference given it is CRAM-MD5, PLAIN, LOGIN. Supported mechanisms are CRAM-MD5, PLAIN and LOGIN,
+// other names never match. A client set with SMTP has to report extensions like *smtp.Client does.
+func AutoAuth(preferred ...string) Option {
+	return func(s *Sender) {
+		s.authMethod = authMethodAuto
+		s.authPreference = nil
+		for _, m := range preferred {
+			s.authPreference = append(s.authPreference, authMethod(strings.ToUpper(strings.TrimSpace(m))))
+		}
+	}
+}
+
 // TimeOut sets smtp timeout
 func TimeOut(timeOut time.Duration) Option {
 	return func(s *Sender) {
@@ -0,0 +1,230 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// supported proxy schemes
+const (
+	proxySOCKS5 = "socks5"
+	proxyHTTP   = "http"
+)
+
+// proxyConfig defines the proxy the connection to the server goes through
+type proxyConfig struct {
+	scheme   string // proxySOCKS5 or proxyHTTP
+	address  string // proxy host:port
+	user     string // optional proxy username
+	password string // optional proxy password
+}
+
+// socks5 makes a dial function connecting through SOCKS5 proxy, RFC 1928, with username and password
+// authentication, RFC 1929, if the user is set. The proxy is reached with forward.
+// The server address is passed to the proxy as is, i.e. a host name is resolved by the proxy.
+func (p proxyConfig) socks5(forward DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward(ctx, network, p.address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to socks5 proxy %s: %w", p.address, err)
+		}
+		if err = handshakeWithContext(ctx, conn, func() error { return p.socks5Handshake(conn, address) }); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socks5 proxy %s failed to connect to %s: %w", p.address, address, err)
+		}
+		return conn, nil
+	}
+}
+
+func (p proxyConfig) socks5Handshake(conn net.Conn, address string) error {
+	const (
+		version          = 5
+		methodNoAuth     = 0
+		methodUserPasswd = 2
+		cmdConnect       = 1
+		atypIPv4         = 1
+		atypDomain       = 3
+		atypIPv6         = 4
+	)
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	method := byte(methodNoAuth)
+	if p.user != "" {
+		method = methodUserPasswd
+	}
+	if _, err = conn.Write([]byte{version, 1, method}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != version {
+		return fmt.Errorf("unexpected socks version %d", resp[0])
+	}
+	if resp[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == methodUserPasswd {
+		if len(p.user) > 255 || len(p.password) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{1, byte(len(p.user))}
+		req = append(req, p.user...)
+		req = append(req, byte(len(p.password)))
+		req = append(req, p.password...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{version, cmdConnect, 0}
+	switch ip := net.ParseIP(host); {
+	case ip != nil && ip.To4() != nil:
+		req = append(append(req, atypIPv4), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, atypIPv6), ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(append(req, atypDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply is version, status, reserved, address type, bound address and port, the address is read and dropped
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("connect rejected, reply code %d", reply[1])
+	}
+	var addrLen int
+	switch reply[3] {
+	case atypIPv4:
+		addrLen = net.IPv4len
+	case atypIPv6:
+		addrLen = net.IPv6len
+	case atypDomain:
+		if _, err = io.ReadFull(conn, reply[:1]); err != nil {
+			return err
+		}
+		addrLen = int(reply[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// httpConnect makes a dial function connecting through HTTP proxy with CONNECT method, RFC 9110 section 9.3.6,
+// with basic authentication if the user is set. The proxy is reached with forward.
+func (p proxyConfig) httpConnect(forward DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := forward(ctx, network, p.address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to http proxy %s: %w", p.address, err)
+		}
+		var res net.Conn
+		err = handshakeWithContext(ctx, conn, func() (e error) {
+			res, e = p.httpConnectHandshake(conn, address)
+			return e
+		})
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("http proxy %s failed to connect to %s: %w", p.address, address, err)
+		}
+		return res, nil
+	}
+}
+
+func (p proxyConfig) httpConnectHandshake(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if p.user != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected proxy response %q", resp.Status)
+	}
+	// the server greets right away, the greeting can be in the reader's buffer already
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn is a connection with the part of the input read ahead into the reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// handshakeWithContext runs the proxy handshake on conn and interrupts it as soon as ctx is done
+func handshakeWithContext(ctx context.Context, conn net.Conn, handshake func() error) error {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0)) // deadline in the past fails the blocked reads and writes
+		case <-done:
+		}
+	}()
+
+	err := handshake()
+	close(done)
+	// the watcher is waited for, as ctx is canceled right after the return and it could spoil the connection then.
+	// If it has set the deadline, ctx is done and the handshake fails below.
+	<-stopped
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_ClientSOCKS5Proxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      string
+		password  string
+		host      func(smtpHost string) string // host the sender is set with
+		wantAuth  string                       // user:password the proxy expects, empty for no auth
+		wantReply byte                         // connect reply code
+		wantErr   string
+	}{
+		{name: "no auth, IP address"},
+		{name: "no auth, host name", host: func(string) string { return "localhost" }},
+		{name: "user and password", user: "user", password: "secret", wantAuth: "user:secret"},
+		{name: "wrong password", user: "user", password: "bad", wantAuth: "user:secret", wantErr: "authentication failed"},
+		{name: "auth required", wantAuth: "user:secret", wantErr: "no acceptable authentication method"},
+		{name: "connect rejected", wantReply: 5, wantErr: "connect rejected, reply code 5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			smtpHost, smtpPort, done := startSMTPTestServer(t, greetAndQuitSMTPHandler(nil))
+			proxyAddr, requested := startSOCKS5TestProxy(t, tt.wantAuth, tt.wantReply, smtpPort)
+
+			host := smtpHost
+			if tt.host != nil {
+				host = tt.host(smtpHost)
+			}
+			s := NewSender(host, Port(smtpPort), SOCKS5Proxy(proxyAddr, tt.user, tt.password), TimeOut(time.Second*3))
+			client, _, err := s.client(context.Background(), nil)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "socks5 proxy "+proxyAddr+" failed to connect")
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, client.Quit())
+			waitSMTPTestServer(t, done)
+			assert.Equal(t, net.JoinHostPort(host, strconv.Itoa(smtpPort)), <-requested, "proxy asked for the server address as is")
+		})
+	}
+}
+
+func TestEmail_ClientHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		wantAuth string
+		wantErr  string
+	}{
+		{name: "no auth"},
+		{name: "basic auth", user: "user", password: "secret", wantAuth: "user:secret"},
+		{name: "auth required", wantAuth: "user:secret", wantErr: `unexpected proxy response "407 Proxy Authentication Required"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			smtpHost, smtpPort, done := startSMTPTestServer(t, greetAndQuitSMTPHandler(nil))
+			proxyAddr, requested := startHTTPTestProxy(t, tt.wantAuth)
+
+			s := NewSender(smtpHost, Port(smtpPort), HTTPProxy(proxyAddr, tt.user, tt.password), TimeOut(time.Second*3))
+			client, _, err := s.client(context.Background(), nil)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "http proxy "+proxyAddr+" failed to connect")
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, client.Quit())
+			waitSMTPTestServer(t, done)
+			assert.Equal(t, net.JoinHostPort(smtpHost, strconv.Itoa(smtpPort)), <-requested)
+		})
+	}
+}
+
+func TestEmail_ClientProxyStalled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() { // accepts and never answers
+		conn, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	for _, opt := range []Option{SOCKS5Proxy(listener.Addr().String(), "", ""), HTTPProxy(listener.Addr().String(), "", "")} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		st := time.Now()
+		_, _, err = NewSender("smtp.example.net", opt, TimeOut(time.Minute)).client(ctx, nil)
+		cancel()
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(st), time.Second, "proxy handshake interrupted by the context")
+	}
+}
+
+func TestEmail_ClientProxyWithDialContext(t *testing.T) {
+	smtpHost, smtpPort, done := startSMTPTestServer(t, greetAndQuitSMTPHandler(nil))
+	proxyAddr, _ := startHTTPTestProxy(t, "")
+
+	var dialed string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = address
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	s := NewSender(smtpHost, Port(smtpPort), HTTPProxy(proxyAddr, "", ""), DialContext(dial))
+	client, _, err := s.client(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, client.Quit())
+	waitSMTPTestServer(t, done)
+	assert.Equal(t, proxyAddr, dialed, "the proxy is reached with the custom dialer")
+}
+
+func TestHandshakeWithContext(t *testing.T) {
+	var deadlines int32
+	for i := 0; i < 500; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		conn := &deadlineTestConn{set: &deadlines}
+		require.NoError(t, handshakeWithContext(ctx, conn, func() error { return nil }))
+		cancel() // like dial does right after the connection is made
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&deadlines), "no deadline set on the established connection")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &deadlineTestConn{set: &deadlines}
+	err := handshakeWithContext(ctx, conn, func() error {
+		cancel()
+		for atomic.LoadInt32(&deadlines) == 0 { // blocked until the deadline is set
+			time.Sleep(time.Millisecond)
+		}
+		return errors.New("i/o timeout")
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+// deadlineTestConn counts SetDeadline calls
+type deadlineTestConn struct {
+	net.Conn
+	set *int32
+}
+
+func (c *deadlineTestConn) SetDeadline(time.Time) error {
+	atomic.AddInt32(c.set, 1)
+	return nil
+}
+
+func TestSender_dialerUnsupportedProxy(t *testing.T) {
+	s := NewSender("localhost")
+	s.proxy = proxyConfig{scheme: "ftp", address: "localhost:21"}
+	_, err := s.dialer("tcp")
+	require.EqualError(t, err, `unsupported proxy scheme "ftp"`)
+}
+
+// startSOCKS5TestProxy starts SOCKS5 proxy stand-in for a single connection, connecting it to 127.0.0.1:smtpPort
+// whatever address is asked. Auth is "user:password" the client has to authenticate with, empty for no auth,
+// reply is the code sent back to connect request. Returns the proxy address and the address the client asked for.
+func startSOCKS5TestProxy(t *testing.T, auth string, reply byte, smtpPort int) (addr string, requested <-chan string) {
+	t.Helper()
+	return startTestProxy(t, func(conn net.Conn) (string, error) {
+		buf := make([]byte, 256)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return "", err
+		}
+		methods := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return "", err
+		}
+		want := byte(0)
+		if auth != "" {
+			want = 2
+		}
+		if len(methods) != 1 || methods[0] != want {
+			_, err := conn.Write([]byte{5, 0xff})
+			return "", err
+		}
+		if _, err := conn.Write([]byte{5, want}); err != nil {
+			return "", err
+		}
+
+		if auth != "" {
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return "", err
+			}
+			user := make([]byte, buf[1])
+			if _, err := io.ReadFull(conn, user); err != nil {
+				return "", err
+			}
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return "", err
+			}
+			password := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, password); err != nil {
+				return "", err
+			}
+			if string(user)+":"+string(password) != auth {
+				_, err := conn.Write([]byte{1, 1})
+				return "", err
+			}
+			if _, err := conn.Write([]byte{1, 0}); err != nil {
+				return "", err
+			}
+		}
+
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return "", err
+		}
+		var host string
+		switch buf[3] {
+		case 1, 4:
+			ip := make([]byte, map[byte]int{1: 4, 4: 16}[buf[3]])
+			if _, err := io.ReadFull(conn, ip); err != nil {
+				return "", err
+			}
+			host = net.IP(ip).String()
+		case 3:
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return "", err
+			}
+			name := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, name); err != nil {
+				return "", err
+			}
+			host = string(name)
+		default:
+			return "", fmt.Errorf("unexpected address type %d", buf[3])
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return "", err
+		}
+		requested := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+		// bound address as a domain name, to check the variable length reply is read fully
+		resp := append([]byte{5, reply, 0, 3, 5}, "proxy"...)
+		if _, err := conn.Write(append(resp, 0, 0)); err != nil {
+			return "", err
+		}
+		if reply != 0 {
+			return "", errors.New("rejected")
+		}
+		return requested, nil
+	}, smtpPort)
+}
+
+// startHTTPTestProxy starts HTTP CONNECT proxy stand-in for a single connection, connecting it to the requested address.
+// Auth is "user:password" the client has to authenticate with, empty for no auth.
+func startHTTPTestProxy(t *testing.T, auth string) (addr string, requested <-chan string) {
+	t.Helper()
+	return startTestProxy(t, func(conn net.Conn) (string, error) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect {
+			return "", fmt.Errorf("unexpected method %q", req.Method)
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+			_, err = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			if err == nil {
+				err = errors.New("unauthorized")
+			}
+			return "", err
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, err
+	}, 0)
+}
+
+// startTestProxy accepts a single connection, runs the handshake on it and connects it to the address
+// returned by the handshake, or to 127.0.0.1:port if the port is not zero
+func startTestProxy(t *testing.T, handshake func(net.Conn) (string, error), port int) (addr string, requested <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	result := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		target, err := handshake(conn)
+		if err != nil {
+			return
+		}
+		result <- target
+		if port != 0 {
+			target = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	}()
+	return listener.Addr().String(), result
+}
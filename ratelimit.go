@@ -0,0 +1,192 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdleDomainBuckets is the number of per-domain buckets kept before the full ones, i.e. idle, are dropped
+const maxIdleDomainBuckets = 1024
+
+// RateLimitError is returned instead of waiting for the rate limit, if the sender is set to fail fast
+type RateLimitError struct {
+	Scope      string        // "global" or the recipient domain which limit is exceeded
+	RetryAfter time.Duration // time until the message is allowed
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %s exceeded, retry after %v", e.Scope, e.RetryAfter)
+}
+
+// RateLimitStats reports how the rate limit affected the sends
+type RateLimitStats struct {
+	Waits    int64         // sends delayed by the limit
+	WaitTime time.Duration // total time the sends waited
+	Rejected int64         // sends failed fast with *RateLimitError
+}
+
+// rateLimiter is a token bucket limit of messages, global and per recipient domain
+type rateLimiter struct {
+	mu          sync.Mutex
+	global      *tokenBucket // nil if not limited
+	domainRate  float64      // messages per second for each recipient domain, not limited if zero
+	domainBurst int
+	domains     map[string]*tokenBucket
+	failFast    bool
+	stats       RateLimitStats
+}
+
+// tokenBucket allows burst messages at once and refills at rate per second, tokens go below zero for reserved waits
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// wait takes a token for the message from the global bucket and the bucket of each recipient domain,
+// waiting until all of them have it, or failing with *RateLimitError right away if set to fail fast.
+// Nil limiter allows everything.
+func (l *rateLimiter) wait(ctx context.Context, recipients []string, now time.Time, logger Logger) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	buckets, scopes := l.buckets(recipients, now)
+	var delay time.Duration
+	var scope string
+	for i, b := range buckets {
+		if d := b.delay(); d > delay {
+			delay, scope = d, scopes[i]
+		}
+	}
+	if delay > 0 && l.failFast {
+		l.stats.Rejected++
+		l.mu.Unlock()
+		return &RateLimitError{Scope: scope, RetryAfter: delay}
+	}
+	for _, b := range buckets {
+		b.tokens-- // reserved now, so the concurrent sends queue behind this one
+	}
+	if delay > 0 {
+		l.stats.Waits++
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	logger.Logf("[DEBUG] rate limit of %s exceeded, waiting %v", scope, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start := time.Now()
+	select {
+	case <-timer.C:
+		l.addWaitTime(time.Since(start))
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		for _, b := range buckets {
+			b.tokens++ // not sent, the reservation is returned
+		}
+		l.stats.WaitTime += time.Since(start)
+		l.mu.Unlock()
+		return fmt.Errorf("rate limit wait interrupted: %w", ctx.Err())
+	}
+}
+
+func (l *rateLimiter) addWaitTime(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.WaitTime += d
+}
+
+// buckets returns the buckets the message takes a token from, with the scope names, refilled to now
+func (l *rateLimiter) buckets(recipients []string, now time.Time) (buckets []*tokenBucket, scopes []string) {
+	if l.global != nil {
+		l.global.refill(now)
+		buckets, scopes = append(buckets, l.global), append(scopes, "global")
+	}
+	if l.domainRate <= 0 {
+		return buckets, scopes
+	}
+
+	seen := map[string]bool{}
+	for _, rcpt := range recipients {
+		addr := extractEmailAddress(rcpt)
+		domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		b, ok := l.domains[domain]
+		if !ok {
+			l.pruneDomains(now)
+			b = newTokenBucket(l.domainRate, l.domainBurst, now)
+			l.domains[domain] = b
+		}
+		b.refill(now)
+		buckets, scopes = append(buckets, b), append(scopes, domain)
+	}
+	return buckets, scopes
+}
+
+// pruneDomains drops the buckets which are full, as they are the same as new ones, once there are too many of them
+func (l *rateLimiter) pruneDomains(now time.Time) {
+	if len(l.domains) < maxIdleDomainBuckets {
+		return
+	}
+	for domain, b := range l.domains {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.domains, domain)
+		}
+	}
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// delay returns the time until the bucket has a token
+func (b *tokenBucket) delay() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// RateLimitStats returns the waits and rejections caused by the rate limit since the sender was made
+func (em *Sender) RateLimitStats() RateLimitStats {
+	if em.rateLimiter == nil {
+		return RateLimitStats{}
+	}
+	em.rateLimiter.mu.Lock()
+	defer em.rateLimiter.mu.Unlock()
+	return em.rateLimiter.stats
+}
+
+// limiter returns the rate limiter of the sender, made on the first use by the options
+func (em *Sender) limiter() *rateLimiter {
+	if em.rateLimiter == nil {
+		em.rateLimiter = &rateLimiter{}
+	}
+	return em.rateLimiter
+}
@@ -0,0 +1,139 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_RateLimit(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}
+
+	t.Run("wait", func(t *testing.T) {
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("localhost", SMTP(newTestSMTPClient()), RateLimit(20, 2), Log(newTestLogger(logBuff)))
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			require.NoError(t, s.SendContext(context.Background(), "test body", params))
+		}
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(t, elapsed, 40*time.Millisecond, "third message waits for a token")
+		stats := s.RateLimitStats()
+		assert.Equal(t, int64(1), stats.Waits)
+		assert.Equal(t, int64(0), stats.Rejected)
+		assert.GreaterOrEqual(t, stats.WaitTime, 40*time.Millisecond)
+		assert.Contains(t, logBuff.String(), "[DEBUG] rate limit of global exceeded, waiting")
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		client := newTestSMTPClient()
+		s := NewSender("localhost", SMTP(client), RateLimit(1, 1), RateLimitFailFast(true))
+
+		require.NoError(t, s.SendContext(context.Background(), "test body", params))
+		err := s.SendContext(context.Background(), "test body", params)
+		var limitErr *RateLimitError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, "global", limitErr.Scope)
+		assert.Greater(t, limitErr.RetryAfter, 900*time.Millisecond)
+		assert.Len(t, client.MailCalls(), 1)
+		assert.Len(t, client.CloseCalls(), 1, "client closed on the rejected send")
+		assert.Equal(t, RateLimitStats{Rejected: 1}, s.RateLimitStats())
+	})
+
+	t.Run("per domain", func(t *testing.T) {
+		s := NewSender("localhost", SMTP(newTestSMTPClient()), DomainRateLimit(1, 1), RateLimitFailFast(true))
+
+		require.NoError(t, s.SendContext(context.Background(), "test body", params))
+		require.NoError(t, s.SendContext(context.Background(), "test body",
+			Params{From: "from@example.com", To: []string{"to@example.org"}}), "other domain has its own limit")
+		err := s.SendContext(context.Background(), "test body",
+			Params{From: "from@example.com", To: []string{"to@example.net", "Some One <one@EXAMPLE.com>"}})
+		var limitErr *RateLimitError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, "example.com", limitErr.Scope)
+		assert.EqualError(t, err, "rate limit of example.com exceeded, retry after "+limitErr.RetryAfter.String())
+
+		// rejected message takes no tokens, so example.net is still allowed
+		require.NoError(t, s.SendContext(context.Background(), "test body",
+			Params{From: "from@example.com", To: []string{"to@example.net"}}))
+	})
+
+	t.Run("context canceled while waiting", func(t *testing.T) {
+		s := NewSender("localhost", SMTP(newTestSMTPClient()), RateLimit(1, 1))
+		require.NoError(t, s.SendContext(context.Background(), "test body", params))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := s.SendContext(ctx, "test body", params)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Contains(t, err.Error(), "rate limit wait interrupted")
+		assert.Equal(t, int64(1), s.RateLimitStats().Waits)
+		assert.Less(t, s.rateLimiter.global.tokens, 0.1, "canceled reservation returned")
+		assert.Greater(t, s.rateLimiter.global.tokens, -0.1, "canceled reservation returned")
+	})
+
+	t.Run("route transport limit", func(t *testing.T) {
+		_, espClient := newTestRelay("esp.example.net", nil)
+		esp := NewSender("esp.example.net", SMTP(espClient), RateLimit(1, 1), RateLimitFailFast(true))
+		s := NewSender("localhost", SMTP(newTestSMTPClient()), Route("example.com", esp))
+
+		require.NoError(t, s.SendContext(context.Background(), "test body", params))
+		err := s.SendContext(context.Background(), "test body", params)
+		var limitErr *RateLimitError
+		require.ErrorAs(t, err, &limitErr, "limit of the route transport applied")
+		assert.Len(t, espClient.MailCalls(), 1)
+		assert.Equal(t, RateLimitStats{Rejected: 1}, esp.RateLimitStats())
+
+		require.NoError(t, s.SendContext(context.Background(), "test body",
+			Params{From: "from@example.com", To: []string{"to@example.org"}}), "not routed, not limited")
+	})
+
+	t.Run("failover relay limit", func(t *testing.T) {
+		_, limitedClient := newTestRelay("limited.example.net", nil)
+		limited := NewSender("limited.example.net", SMTP(limitedClient), RateLimit(1, 1), RateLimitFailFast(true))
+		backup, backupClient := newTestRelay("backup.example.net", nil)
+		logBuff := bytes.NewBuffer(nil)
+		primary, _ := newTestRelay("primary.example.net", &textproto.Error{Code: 421, Msg: "busy"})
+		s := NewSender("primary.example.net", SMTP(primary.smtpClient), Log(newTestLogger(logBuff)),
+			Failover(time.Minute, limited, backup))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, "limited.example.net:25", res.Relay)
+		res, err = s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, "backup.example.net:25", res.Relay, "rate limited relay skipped")
+		assert.Len(t, limitedClient.MailCalls(), 1)
+		assert.Len(t, backupClient.MailCalls(), 1)
+		assert.Contains(t, logBuff.String(), "[WARN] relay limited.example.net:25 skipped, rate limit of global exceeded")
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		s := NewSender("localhost", SMTP(newTestSMTPClient()), RateLimit(0, 10))
+		assert.Nil(t, s.rateLimiter)
+		require.NoError(t, s.SendContext(context.Background(), "test body", params))
+		assert.Equal(t, RateLimitStats{}, s.RateLimitStats())
+	})
+}
+
+func TestRateLimiter_pruneDomains(t *testing.T) {
+	now := time.Now()
+	l := &rateLimiter{domainRate: 1, domainBurst: 1, domains: map[string]*tokenBucket{}}
+	for i := 0; i < maxIdleDomainBuckets; i++ {
+		l.domains[string(rune('a'+i%26))+time.Duration(i).String()] = newTokenBucket(1, 1, now)
+	}
+	l.domains["busy.example.com"] = &tokenBucket{rate: 1, burst: 1, tokens: -1, last: now}
+
+	_, scopes := l.buckets([]string{"to@new.example.com"}, now)
+	assert.Equal(t, []string{"new.example.com"}, scopes)
+	assert.Len(t, l.domains, 2, "full buckets dropped, busy one kept")
+	assert.Contains(t, l.domains, "busy.example.com")
+}
@@ -0,0 +1,87 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// SendRaw sends the pre-built RFC 5322 message, as read from r, to the envelope recipients rcpts, with envelopeFrom
+// given to MAIL FROM, empty for the null reverse-path. The message is sent as is, except the line endings
+// normalised to CRLF and dot-stuffing. Connection, TLS, auth, context, failover and the other delivery options
+// apply the way they do for SendContext, RedirectAll adds X-Original-To header. Middlewares don't apply,
+// as they work with the text and params the message is built from.
+func (em *Sender) SendRaw(ctx context.Context, envelopeFrom string, rcpts []string, r io.Reader) error {
+	em.logger.Logf("[DEBUG] send raw message from %q to %v", envelopeFrom, rcpts)
+	params := Params{From: envelopeFrom, To: rcpts}
+
+	start := time.Now()
+	data, res, err := em.deliverRaw(ctx, params, r)
+	// raw message is logged with its size only, the text would be all of it, headers and encoded attachments
+	em.logDelivery(ctx, params, func() []eventAttr { return []eventAttr{{"body_size", len(data)}} }, data, res, err,
+		time.Since(start))
+	return err
+}
+
+// deliverRaw reads and delivers the raw message, returning it for the logging
+func (em *Sender) deliverRaw(ctx context.Context, params Params, r io.Reader) ([]byte, *Result, error) {
+	if err := em.allowSend(); err != nil {
+		return nil, nil, err
+	}
+	msg, params, err := em.prepareRaw(ctx, params, r)
+	if err != nil {
+		em.breaker.skip()
+		em.closeSMTPClient()
+		return msg, nil, withPhase(phasePrepare, err)
+	}
+	if len(params.To) == 0 { // all the recipients dropped by the allowlist, nothing to send
+		em.breaker.skip()
+		em.closeSMTPClient()
+		return msg, &Result{}, nil
+	}
+	res, err := em.deliverBuilt(ctx, &payload{head: msg, size: int64(len(msg))}, params, em.routeMessage)
+	return msg, res, err
+}
+
+// prepareRaw reads the message with the line endings normalised, and applies the staging policy to the recipients
+func (em *Sender) prepareRaw(ctx context.Context, params Params, r io.Reader) ([]byte, Params, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, params, err
+	}
+	if len(params.To) == 0 {
+		return nil, params, errors.New("no recipients")
+	}
+	for _, addr := range append([]string{params.From}, params.To...) {
+		if err := validateLine(addr); err != nil {
+			return nil, params, fmt.Errorf("invalid envelope address %q: %w", addr, err)
+		}
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, params, fmt.Errorf("can't read raw message: %w", err)
+	}
+	msg := toCRLF(data)
+	if err = em.checkMessageSize(int64(len(msg))); err != nil {
+		return msg, params, err
+	}
+
+	if params, err = em.applyStaging(params); err != nil {
+		return msg, params, err
+	}
+	if len(params.originalTo) > 0 { // prepended, like trace headers are
+		to, err := formatAddressList("X-Original-To", params.originalTo)
+		if err != nil {
+			return msg, params, err
+		}
+		line, err := foldHeader("X-Original-To", to)
+		if err != nil {
+			return msg, params, err
+		}
+		msg = append([]byte(strings.ReplaceAll(line, "\n", "\r\n")+"\r\n"), msg...)
+	}
+	return msg, params, nil
+}
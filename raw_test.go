@@ -0,0 +1,135 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_SendRaw(t *testing.T) {
+	var data string
+	host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+		reader := bufio.NewReader(conn)
+		if err := writeSMTPResponse(conn, "220 smtp.example.net ESMTP ready"); err != nil {
+			return err
+		}
+		for _, reply := range []string{"250 smtp.example.net", "250 ok", "250 ok", "250 ok", "354 go ahead"} {
+			if _, err := readSMTPCommand(reader); err != nil {
+				return err
+			}
+			if err := writeSMTPResponse(conn, reply); err != nil {
+				return err
+			}
+		}
+		buff := bytes.NewBuffer(nil)
+		for { // raw data, as it's on the wire
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if line == ".\r\n" {
+				break
+			}
+			buff.WriteString(line)
+		}
+		data = buff.String()
+		if err := writeSMTPResponse(conn, "250 queued"); err != nil {
+			return err
+		}
+		return expectSMTPQuit(conn, reader)
+	})
+
+	raw := "From: a@example.com\nTo: b@example.com\r\nSubject: raw\r\n\nline one\r.\n..two dots\n.\nlast"
+	s := NewSender(host, Port(port))
+	err := s.SendRaw(context.Background(), "bounce@example.com", []string{"b@example.com", "c@example.com"}, strings.NewReader(raw))
+	require.NoError(t, err)
+	waitSMTPTestServer(t, done)
+	assert.Equal(t, "From: a@example.com\r\nTo: b@example.com\r\nSubject: raw\r\n\r\nline one\r\n..\r\n...two dots\r\n..\r\nlast\r\n", data,
+		"CRLF line endings, dots stuffed")
+}
+
+func TestEmail_SendRawEnvelope(t *testing.T) {
+	client := newTestSMTPClient()
+	wc := &fakeWriterCloser{buff: bytes.NewBuffer(nil)}
+	client.DataFunc = func() (io.WriteCloser, error) { return wc, nil }
+	s := NewSender("localhost", SMTP(client), RedirectAll("qa@example.com"))
+
+	err := s.SendRaw(context.Background(), "", []string{"to@example.com"}, strings.NewReader("Subject: raw\n\nbody\n"))
+	require.NoError(t, err)
+	require.Len(t, client.MailCalls(), 1)
+	assert.Equal(t, "", client.MailCalls()[0].From, "null reverse-path")
+	require.Len(t, client.RcptCalls(), 1)
+	assert.Equal(t, "qa@example.com", client.RcptCalls()[0].To)
+	assert.Equal(t, "X-Original-To: to@example.com\r\nSubject: raw\r\n\r\nbody\r\n", wc.buff.String())
+}
+
+func TestEmail_SendRawLongRedirectedList(t *testing.T) {
+	client := newTestSMTPClient()
+	wc := &fakeWriterCloser{buff: bytes.NewBuffer(nil)}
+	client.DataFunc = func() (io.WriteCloser, error) { return wc, nil }
+	s := NewSender("localhost", SMTP(client), RedirectAll("qa@example.com"))
+
+	rcpts := make([]string, 0, 15)
+	for i := 0; i < 15; i++ {
+		rcpts = append(rcpts, fmt.Sprintf("recipient%02d@example.com", i))
+	}
+	require.NoError(t, s.SendRaw(context.Background(), "from@example.com", rcpts, strings.NewReader("Subject: raw\n\nbody\n")))
+
+	head := wc.buff.String()[:strings.Index(wc.buff.String(), "Subject: raw")]
+	lines := strings.Split(strings.TrimSuffix(head, "\r\n"), "\r\n")
+	require.Greater(t, len(lines), 1, "folded")
+	for _, line := range lines {
+		assert.LessOrEqual(t, len(line), maxHeaderLineLen, line)
+	}
+	parsed, err := ParseMessage(strings.NewReader(wc.buff.String()))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(rcpts, ","), strings.ReplaceAll(parsed.Header.Get("X-Original-To"), " ", ""))
+
+	wc.buff.Reset()
+	long := "bounce-" + strings.Repeat("x", 80) + "@example.com"
+	require.NoError(t, s.SendRaw(context.Background(), "from@example.com", []string{"a@example.com", long},
+		strings.NewReader("Subject: raw\n\nbody\n")))
+	parsed, err = ParseMessage(strings.NewReader(wc.buff.String()))
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com,"+long, strings.ReplaceAll(parsed.Header.Get("X-Original-To"), " ", ""))
+	assert.Equal(t, "raw", parsed.Subject, "headers after the long address kept")
+
+	err = s.SendRaw(context.Background(), "from@example.com", []string{"local"}, strings.NewReader("Subject: raw\n\nbody\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid X-Original-To address "local"`)
+}
+
+func TestEmail_SendRawErrors(t *testing.T) {
+	s := NewSender("localhost", SMTP(newTestSMTPClient()))
+
+	err := s.SendRaw(context.Background(), "from@example.com", nil, strings.NewReader("body"))
+	require.EqualError(t, err, "no recipients")
+
+	err = s.SendRaw(context.Background(), "from@example.com", []string{"to@example.com\r\nRCPT TO:<x@example.com>"}, strings.NewReader("body"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid envelope address")
+
+	err = s.SendRaw(context.Background(), "from@example.com", []string{"to@example.com"}, iotest.ErrReader(errors.New("read failed")))
+	require.EqualError(t, err, "can't read raw message: read failed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.SendRaw(ctx, "from@example.com", []string{"to@example.com"}, strings.NewReader("body"))
+	require.ErrorIs(t, err, context.Canceled)
+
+	dry := NewSender("localhost", DryRun(true))
+	res, err := dry.deliverBuilt(context.Background(), &payload{head: []byte("body")},
+		Params{To: []string{"to@example.com"}}, dry.routeMessage)
+	require.NoError(t, err, "null reverse-path is fine in dry run")
+	assert.Equal(t, "localhost:25", res.Relay)
+}
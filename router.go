@@ -0,0 +1,83 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// route sends the recipients matching the pattern through the transport
+type route struct {
+	pattern   string
+	transport *Sender
+}
+
+// match checks the recipient address against the pattern, the whole address if the pattern has "@", the domain otherwise
+func (r route) match(addr string) bool {
+	addr = strings.ToLower(addr)
+	if !strings.Contains(r.pattern, "@") {
+		addr = addr[strings.LastIndex(addr, "@")+1:]
+	}
+	ok, err := path.Match(r.pattern, addr)
+	return err == nil && ok
+}
+
+// routeMessage splits the recipients by the routes, the first matching one wins and the rest go through the sender
+// itself. Each route gets a transaction of its own, results are merged like for direct MX delivery.
+func (em *Sender) routeMessage(ctx context.Context, msg *payload, params Params) (*Result, error) {
+	if len(em.routes) == 0 {
+		return em.deliverMessage(ctx, msg, params)
+	}
+
+	transports := []*Sender{}
+	groups := map[*Sender][]string{}
+	for _, rcpt := range params.To {
+		transport := em.routeOf(extractEmailAddress(rcpt))
+		if _, ok := groups[transport]; !ok {
+			transports = append(transports, transport)
+		}
+		groups[transport] = append(groups[transport], rcpt)
+	}
+
+	rcpts := make([][]string, 0, len(transports))
+	results := make([]*Result, 0, len(transports))
+	errs := make([]error, 0, len(transports))
+	for _, transport := range transports {
+		p := params
+		p.To = groups[transport]
+		_, addr := transport.serverAddress()
+		em.logger.Logf("[DEBUG] %d of %d recipients routed to %s", len(p.To), len(params.To), addr)
+		res, err := em.deliverRoute(ctx, transport, msg, p)
+		if len(transports) == 1 {
+			return res, err
+		}
+		if err != nil {
+			err = fmt.Errorf("route to %s failed: %w", addr, err)
+		}
+		rcpts, results, errs = append(rcpts, p.To), append(results, res), append(errs, err)
+		if ctx.Err() != nil {
+			break // the rest of routes would fail the same way
+		}
+	}
+	return mergeResults(rcpts, results, errs)
+}
+
+// deliverRoute sends the message through the transport, with its own dry run, circuit breaker and rate limit.
+// The sender itself has them applied already.
+func (em *Sender) deliverRoute(ctx context.Context, transport *Sender, msg *payload, params Params) (*Result, error) {
+	if transport == em {
+		return em.deliverMessage(ctx, msg, params)
+	}
+	return transport.sendThrough(ctx, msg, params, transport.deliverMessage)
+}
+
+// routeOf returns the transport of the first route matching the address, the sender itself if none does
+func (em *Sender) routeOf(addr string) *Sender {
+	for _, r := range em.routes {
+		if r.match(addr) {
+			return r.transport
+		}
+	}
+	return em
+}
@@ -0,0 +1,94 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_DeliverRoutes(t *testing.T) {
+	params := Params{From: "from@example.com", Subject: "subj",
+		To: []string{"a@corp.example.com", "b@gmail.com", "c@dev.corp.example.com", "Boss <boss@example.com>"}}
+
+	t.Run("split by route", func(t *testing.T) {
+		internal, internalClient := newTestRelay("internal.example.com", nil)
+		vip, vipClient := newTestRelay("vip.example.com", nil)
+		_, espClient := newTestRelay("esp.example.net", nil)
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("esp.example.net", SMTP(espClient), Log(newTestLogger(logBuff)),
+			Route("boss@example.com", vip), Route("corp.example.com", internal), Route("*.corp.example.com", internal))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, "internal.example.com:25, esp.example.net:25, vip.example.com:25", res.Relay)
+		assert.Equal(t, []RecipientStatus{{Address: "a@corp.example.com"}, {Address: "c@dev.corp.example.com"},
+			{Address: "b@gmail.com"}, {Address: "boss@example.com"}}, res.Recipients)
+
+		require.Len(t, internalClient.RcptCalls(), 2)
+		assert.Equal(t, "a@corp.example.com", internalClient.RcptCalls()[0].To)
+		assert.Equal(t, "c@dev.corp.example.com", internalClient.RcptCalls()[1].To)
+		require.Len(t, espClient.RcptCalls(), 1)
+		assert.Equal(t, "b@gmail.com", espClient.RcptCalls()[0].To)
+		require.Len(t, vipClient.RcptCalls(), 1)
+		assert.Equal(t, "boss@example.com", vipClient.RcptCalls()[0].To)
+
+		assert.Len(t, internalClient.DataCalls(), 1)
+		assert.Contains(t, logBuff.String(), "[DEBUG] 2 of 4 recipients routed to internal.example.com:25")
+	})
+
+	t.Run("single route", func(t *testing.T) {
+		internal, internalClient := newTestRelay("internal.example.com", &textproto.Error{Code: 550, Msg: "no such user"})
+		_, espClient := newTestRelay("esp.example.net", nil)
+		s := NewSender("esp.example.net", SMTP(espClient), Route("*.example.com", internal))
+
+		_, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com", To: []string{"a@corp.example.com"}})
+		require.Error(t, err)
+		assert.NotContains(t, err.Error(), "route to", "error of the only route is returned as is")
+		assert.Len(t, internalClient.MailCalls(), 1)
+		assert.Empty(t, espClient.MailCalls())
+	})
+
+	t.Run("one route failed", func(t *testing.T) {
+		internal, _ := newTestRelay("internal.example.com", &textproto.Error{Code: 451, Msg: "try later"})
+		_, espClient := newTestRelay("esp.example.net", nil)
+		s := NewSender("esp.example.net", SMTP(espClient), Route("*corp.example.com", internal))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.Error(t, err)
+		var rcptErr *RecipientsError
+		require.ErrorAs(t, err, &rcptErr)
+		assert.Contains(t, err.Error(), "rejected for 2 of 4 recipients, a@corp.example.com: route to internal.example.com:25 failed")
+		assert.Equal(t, "esp.example.net:25", res.Relay)
+		require.Len(t, res.Recipients, 4)
+		assert.Error(t, res.Recipients[0].Err)
+		assert.Error(t, res.Recipients[1].Err)
+		assert.NoError(t, res.Recipients[2].Err)
+		assert.NoError(t, res.Recipients[3].Err)
+	})
+}
+
+func TestRoute_match(t *testing.T) {
+	tbl := []struct {
+		pattern, addr string
+		match         bool
+	}{
+		{"example.com", "user@example.com", true},
+		{"example.com", "user@EXAMPLE.com", true},
+		{"example.com", "user@sub.example.com", false},
+		{"*.example.com", "user@sub.example.com", true},
+		{"*.example.com", "user@example.com", false},
+		{"*@example.com", "user@example.com", true},
+		{"admin@example.com", "user@example.com", false},
+		{"admin+*@example.com", "admin+alerts@example.com", true},
+		{"[", "user@example.com", false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.pattern+" "+tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.match, route{pattern: tt.pattern}.match(tt.addr))
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package email
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SizeLimit is the kind of the size limit the message exceeds
+type SizeLimit string
+
+// size limits
+const (
+	SizeLimitMessage    SizeLimit = "message"    // set with MaxMessageSize
+	SizeLimitAttachment SizeLimit = "attachment" // set with MaxAttachmentSize, for each file
+	SizeLimitServer     SizeLimit = "server"     // advertised by the server with SIZE extension, RFC 1870
+)
+
+// SizeLimitError is the message, or a file of it, exceeding the size limit
+type SizeLimitError struct {
+	Limit SizeLimit
+	File  string // path of the file exceeding the attachment limit, empty for the other limits
+	Size  int64  // size of the file, or the message with the files encoded, bytes
+	Max   int64  // the limit, bytes
+}
+
+func (e *SizeLimitError) Error() string {
+	switch e.Limit {
+	case SizeLimitAttachment:
+		return fmt.Sprintf("attachment %q size %d exceeds limit %d", e.File, e.Size, e.Max)
+	case SizeLimitServer:
+		return fmt.Sprintf("message size %d exceeds server limit %d", e.Size, e.Max)
+	}
+	return fmt.Sprintf("message size %d exceeds limit %d", e.Size, e.Max)
+}
+
+// checkSizeLimits returns the size of the message, failing if it or any of its files exceeds the limit.
+// Sizes of the files are taken from the file system, so nothing is encoded for the check.
+func (em *Sender) checkSizeLimits(msg *payload) (int64, error) {
+	if msg.parts != nil && em.maxAttachmentSize > 0 {
+		for _, file := range append(append([]*os.File{}, msg.parts.inline...), msg.parts.attachments...) {
+			info, err := file.Stat()
+			if err != nil {
+				return 0, err
+			}
+			if info.Size() > em.maxAttachmentSize {
+				return 0, &SizeLimitError{Limit: SizeLimitAttachment, File: file.Name(), Size: info.Size(), Max: em.maxAttachmentSize}
+			}
+		}
+	}
+	size, err := messageSize(msg)
+	if err != nil {
+		return 0, err
+	}
+	return size, em.checkMessageSize(size)
+}
+
+// checkBuildLimits checks the size limits of the message built in memory, before its files are encoded
+func (em *Sender) checkBuildLimits(head *messageHead, params Params) error {
+	parts, err := openParts(head, params)
+	if err != nil {
+		return err
+	}
+	msg := &payload{head: head.data.Bytes(), parts: parts}
+	defer msg.close(em.logger)
+	_, err = em.checkSizeLimits(msg)
+	return err
+}
+
+// checkMessageSize fails if the message size exceeds MaxMessageSize
+func (em *Sender) checkMessageSize(size int64) error {
+	if em.maxMessageSize > 0 && size > em.maxMessageSize {
+		return &SizeLimitError{Limit: SizeLimitMessage, Size: size, Max: em.maxMessageSize}
+	}
+	return nil
+}
+
+// messageSize returns the size the message has when sent, with the file parts made of the headers
+// and the encoded size of the files, without reading them
+func messageSize(msg *payload) (int64, error) {
+	if msg.parts == nil {
+		return wireSize(msg.head), nil
+	}
+	counter := &countingWriter{n: wireSize(msg.head)}
+	groups := []struct {
+		boundary, disposition string
+		files                 []*os.File
+	}{{msg.parts.boundaryRelated, "inline", msg.parts.inline}, {msg.parts.boundaryMixed, "attachment", msg.parts.attachments}}
+	for _, group := range groups {
+		if len(group.files) == 0 {
+			continue
+		}
+		counter.n += 4 // blank line before the parts
+		mp := partsWriter(counter, group.boundary)
+		for _, file := range group.files {
+			header, err := filePartHeader(file, group.disposition)
+			if err != nil {
+				return 0, err
+			}
+			if _, err = mp.CreatePart(header); err != nil {
+				return 0, err
+			}
+			info, err := file.Stat()
+			if err != nil {
+				return 0, err
+			}
+			counter.n += base64WrappedLen(info.Size())
+		}
+		if err := mp.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return counter.n, nil
+}
+
+// wireSize returns the size of the data sent with DATA, where bare LF goes as CRLF
+func wireSize(data []byte) int64 {
+	size := int64(len(data))
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			size++
+		}
+	}
+	return size
+}
+
+// base64WrappedLen returns the size of base64 encoded data of n bytes, with the lines broken by lineWrapper
+func base64WrappedLen(n int64) int64 {
+	encoded := (n + 2) / 3 * 4
+	if encoded == 0 {
+		return 0
+	}
+	return encoded + int64(len(crlf))*((encoded-1)/base64LineLimit)
+}
+
+// checkServerSize fails if the message is larger than the server accepts, as it advertises with SIZE extension.
+// Servers with no SIZE, or SIZE without the limit, are not checked.
+func checkServerSize(client SMTPClient, size int64) error {
+	reporter, ok := client.(extensionReporter)
+	if !ok {
+		return nil
+	}
+	supported, param := reporter.Extension("SIZE")
+	if !supported {
+		return nil
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(param), 10, 64)
+	if err != nil || limit <= 0 {
+		return nil
+	}
+	if size > limit {
+		return &SizeLimitError{Limit: SizeLimitServer, Size: size, Max: limit}
+	}
+	return nil
+}
+
+// mailFrom starts the transaction, declaring the message size with SIZE parameter if the server supports it.
+// smtp.Client can't add the parameter, so MAIL FROM is sent for it on its own then.
+func mailFrom(client SMTPClient, from string, size int64) error {
+	switch c := client.(type) {
+	case *smtp.Client:
+		if ok, _ := c.Extension("SIZE"); ok && size > 0 {
+			return smtpMailSize(c, from, size)
+		}
+	case *lmtpClient:
+		return c.mail(from, size)
+	}
+	return client.Mail(from)
+}
+
+// smtpMailSize sends MAIL FROM with the parameters smtp.Client.Mail adds, and SIZE
+func smtpMailSize(c *smtp.Client, from string, size int64) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	id, err := c.Text.Cmd(cmd+" SIZE=%d", from, size)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// countingWriter counts the bytes written to it and drops them
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,171 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_SizeLimits(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"},
+		Attachments: []string{"testdata/1.txt", "testdata/image.jpg"}}
+	image, err := os.Stat("testdata/image.jpg")
+	require.NoError(t, err)
+	built, err := NewSender("localhost").BuildMessage("text", params)
+	require.NoError(t, err)
+	msgSize := int64(len(built.Data)) // with CRLF line endings, as sent
+
+	for _, streaming := range []bool{false, true} {
+		t.Run("streaming "+strconv.FormatBool(streaming), func(t *testing.T) {
+			dialed := false
+			dial := DialContext(func(context.Context, string, string) (net.Conn, error) {
+				dialed = true
+				return nil, errors.New("refused")
+			})
+
+			s := NewSender("localhost", dial, Streaming(streaming), MaxAttachmentSize(image.Size()-1))
+			err := s.Send("text", params)
+			var sizeErr *SizeLimitError
+			require.ErrorAs(t, err, &sizeErr)
+			assert.Equal(t, SizeLimitError{Limit: SizeLimitAttachment, File: "testdata/image.jpg", Size: image.Size(),
+				Max: image.Size() - 1}, *sizeErr)
+			assert.Contains(t, err.Error(), fmt.Sprintf(`attachment "testdata/image.jpg" size %d exceeds limit %d`,
+				image.Size(), image.Size()-1))
+
+			s = NewSender("localhost", dial, Streaming(streaming), MaxMessageSize(msgSize-1))
+			err = s.Send("text", params)
+			require.ErrorAs(t, err, &sizeErr)
+			assert.Equal(t, SizeLimitError{Limit: SizeLimitMessage, Size: msgSize, Max: msgSize - 1}, *sizeErr)
+			assert.False(t, dialed, "nothing sent over the limit")
+
+			s = NewSender("localhost", dial, Streaming(streaming), MaxMessageSize(msgSize), MaxAttachmentSize(image.Size()))
+			err = s.Send("text", params)
+			require.Error(t, err)
+			assert.False(t, errors.As(err, &sizeErr), "exactly at the limits")
+			assert.True(t, dialed)
+		})
+	}
+
+	_, err = NewSender("localhost", MaxMessageSize(msgSize-1)).BuildMessage("text", params)
+	assert.ErrorAs(t, err, new(*SizeLimitError))
+
+	err = NewSender("localhost", MaxMessageSize(10)).SendRaw(context.Background(), "from@example.com",
+		[]string{"to@example.com"}, strings.NewReader("Subject: raw\n\nbody"))
+	require.EqualError(t, err, "message size 20 exceeds limit 10")
+}
+
+func TestEmail_ServerSizeLimit(t *testing.T) {
+	timeNow := func() time.Time { return time.Date(2022, time.February, 10, 23, 33, 58, 0, time.UTC) }
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}
+	builder := NewSender("localhost")
+	builder.timeNow = timeNow
+	msg, err := builder.BuildMessage("test body", params)
+	require.NoError(t, err)
+	size := strconv.Itoa(len(msg.Data))
+
+	t.Run("size declared", func(t *testing.T) {
+		host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+			{"EHLO localhost", "250-smtp.example.net\r\n250-8BITMIME\r\n250 SIZE " + size},
+			{"MAIL FROM:<from@example.com> BODY=8BITMIME SIZE=" + size, "250 ok"},
+			{"RCPT TO:<to@example.com>", "250 ok"},
+			{"DATA", "354 go ahead"},
+			{"", "250 queued"},
+			{"QUIT", "221 bye"},
+		}))
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender(host, Port(port), Transcript(TranscriptToLog), Log(newTestLogger(logBuff)))
+		s.timeNow = timeNow
+		require.NoError(t, s.Send("test body", params))
+		waitSMTPTestServer(t, done)
+		assert.Contains(t, logBuff.String(), "C: MAIL FROM:<from@example.com> BODY=8BITMIME SIZE="+size+"\n")
+	})
+
+	t.Run("over server limit", func(t *testing.T) {
+		host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+			{"EHLO localhost", "250-smtp.example.net\r\n250 SIZE 100"},
+		}))
+		s := NewSender(host, Port(port))
+		s.timeNow = timeNow
+		err := s.Send("test body", params)
+		waitSMTPTestServer(t, done)
+		var sizeErr *SizeLimitError
+		require.ErrorAs(t, err, &sizeErr)
+		assert.Equal(t, SizeLimitServer, sizeErr.Limit)
+		assert.Equal(t, int64(100), sizeErr.Max)
+		assert.EqualError(t, err, "message size "+size+" exceeds server limit 100")
+	})
+
+	t.Run("no limit advertised", func(t *testing.T) {
+		host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+			{"EHLO localhost", "250-smtp.example.net\r\n250 SIZE"},
+			{"MAIL FROM:<from@example.com> SIZE=" + size, "250 ok"},
+			{"RCPT TO:<to@example.com>", "250 ok"},
+			{"DATA", "354 go ahead"},
+			{"", "250 queued"},
+			{"QUIT", "221 bye"},
+		}))
+		s := NewSender(host, Port(port))
+		s.timeNow = timeNow
+		require.NoError(t, s.Send("test body", params))
+		waitSMTPTestServer(t, done)
+	})
+}
+
+func TestEmail_LMTPSize(t *testing.T) {
+	path, done := startUnixTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+		{"LHLO localhost", "250-lmtp.example.net\r\n250 SIZE 1000000"},
+		{"MAIL FROM:<from@example.com> SIZE=", "250 ok"},
+		{"RCPT TO:<to@example.com>", "250 ok"},
+		{"DATA", "354 go ahead"},
+		{"", "250 delivered"},
+		{"QUIT", "221 bye"},
+	}))
+	s := NewSender("localhost", UnixSocket(path), LMTP(true))
+	require.NoError(t, s.Send("test body", Params{From: "from@example.com", To: []string{"to@example.com"}}))
+	waitSMTPTestServer(t, done)
+}
+
+func TestMessageSize(t *testing.T) {
+	big := filepath.Join(t.TempDir(), "big.bin")
+	require.NoError(t, os.WriteFile(big, bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, 10_000), 0o600))
+	s := NewSender("localhost", ContentType("text/html"), Streaming(true))
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "size",
+		Attachments:  []string{"testdata/1.txt", "testdata/nullfile", big},
+		InlineImages: []string{"testdata/image.jpg"}}
+
+	msg, err := s.openStream("<p>text</p>", params)
+	require.NoError(t, err)
+	defer msg.close(s.logger)
+	buff := bytes.NewBuffer(nil)
+	require.NoError(t, s.writePayload(context.Background(), buff, msg))
+	assert.Equal(t, int64(len(toCRLF(buff.Bytes()))), msg.size, "computed without encoding the files")
+}
+
+func TestWireSize(t *testing.T) {
+	assert.Equal(t, int64(0), wireSize(nil))
+	assert.Equal(t, int64(2), wireSize([]byte("\n")))
+	assert.Equal(t, int64(8), wireSize([]byte("a\r\nb\nc\r")))
+}
+
+func TestBase64WrappedLen(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 56, 57, 58, 114, 1000, 100_000} {
+		buff := bytes.NewBuffer(nil)
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: buff, limit: base64LineLimit})
+		_, err := encoder.Write(make([]byte, n))
+		require.NoError(t, err)
+		require.NoError(t, encoder.Close())
+		assert.Equal(t, int64(buff.Len()), base64WrappedLen(int64(n)), "size of %d bytes", n)
+	}
+}
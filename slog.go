@@ -0,0 +1,39 @@
+//go:build go1.21
+
+package email
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger sets the slog logger getting a structured event for each send, alongside the Log one.
+// Sent email is logged at info level, failed at error level, with host, from, recipients count, message_id,
+// body (only if set with LogBody, none by default), duration, and for failures phase, smtp_code and error attributes.
+// SMTP and proxy passwords are redacted from the logged values.
+func SlogLogger(logger *slog.Logger) Option {
+	return func(s *Sender) {
+		if logger == nil {
+			s.events = nil
+			return
+		}
+		s.events = slogEvents{logger: logger}
+	}
+}
+
+// slogEvents logs the structured events of the sends with slog
+type slogEvents struct {
+	logger *slog.Logger
+}
+
+func (l slogEvents) event(ctx context.Context, level eventLevel, msg string, attrs []eventAttr) {
+	slogLevel := slog.LevelInfo
+	if level == eventError {
+		slogLevel = slog.LevelError
+	}
+	slogAttrs := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		slogAttrs = append(slogAttrs, slog.Any(a.key, a.value))
+	}
+	l.logger.LogAttrs(ctx, slogLevel, msg, slogAttrs...)
+}
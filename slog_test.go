@@ -0,0 +1,90 @@
+//go:build go1.21
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_SlogLogger(t *testing.T) {
+	params := Params{From: "Me <from@example.com>", To: []string{"to@example.com", "to2@example.com"}, Subject: "subj"}
+
+	t.Run("sent", func(t *testing.T) {
+		buff := bytes.NewBuffer(nil)
+		s := NewSender("smtp.example.com", SMTP(newTestSMTPClient()), LogBody(BodyLogTruncated),
+			SlogLogger(slog.New(slog.NewJSONHandler(buff, nil))))
+
+		_, err := s.Deliver(context.Background(), "hello", params)
+		require.NoError(t, err)
+
+		rec := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(buff.Bytes(), &rec))
+		assert.Equal(t, "INFO", rec["level"])
+		assert.Equal(t, "email sent", rec["msg"])
+		assert.Equal(t, "smtp.example.com:25", rec["host"])
+		assert.Equal(t, "smtp.example.com:25", rec["relay"])
+		assert.Equal(t, "from@example.com", rec["from"])
+		assert.Equal(t, float64(2), rec["recipients"])
+		assert.Equal(t, "hello", rec["body"])
+		assert.Contains(t, rec, "duration")
+		assert.Regexp(t, `^<[0-9a-f]{32}@example\.com>$`, rec["message_id"])
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		buff := bytes.NewBuffer(nil)
+		client := newTestSMTPClient()
+		client.MailFunc = func(string) error { return &textproto.Error{Code: 535, Msg: "bad credentials for user:secret-pass"} }
+		s := NewSender("smtp.example.com", SMTP(client), Auth("user", "secret-pass"), LogBody(BodyLogOff),
+			SlogLogger(slog.New(slog.NewJSONHandler(buff, nil))))
+
+		_, err := s.Deliver(context.Background(), "hello", params)
+		require.Error(t, err)
+
+		rec := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(buff.Bytes(), &rec))
+		assert.Equal(t, "ERROR", rec["level"])
+		assert.Equal(t, "email send failed", rec["msg"])
+		assert.Equal(t, "mail", rec["phase"])
+		assert.Equal(t, float64(535), rec["smtp_code"])
+		assert.Contains(t, rec["error"], "user:[REDACTED]")
+		assert.NotContains(t, buff.String(), "secret-pass")
+		assert.NotContains(t, rec, "body")
+	})
+
+	t.Run("raw message size only", func(t *testing.T) {
+		buff := bytes.NewBuffer(nil)
+		s := NewSender("smtp.example.com", SMTP(newTestSMTPClient()), LogBody(BodyLogFull),
+			SlogLogger(slog.New(slog.NewJSONHandler(buff, nil))))
+
+		raw := "Message-ID: <raw@example.com>\r\nSubject: raw\r\n\r\nsecret raw text\r\n"
+		require.NoError(t, s.SendRaw(context.Background(), "from@example.com", []string{"to@example.com"}, strings.NewReader(raw)))
+
+		rec := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(buff.Bytes(), &rec))
+		assert.NotContains(t, rec, "body")
+		assert.Equal(t, float64(len(raw)), rec["body_size"])
+		assert.Equal(t, "<raw@example.com>", rec["message_id"])
+		assert.NotContains(t, buff.String(), "secret raw text")
+	})
+
+	t.Run("no body by default", func(t *testing.T) {
+		buff := bytes.NewBuffer(nil)
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("smtp.example.com", SMTP(newTestSMTPClient()), Log(newTestLogger(logBuff)),
+			SlogLogger(slog.New(slog.NewJSONHandler(buff, nil))))
+
+		_, err := s.Deliver(context.Background(), "secret message text", params)
+		require.NoError(t, err)
+		assert.NotContains(t, buff.String(), "secret message text", "info level event has no body")
+		assert.Contains(t, logBuff.String(), "secret message text", "full body still logged at debug level")
+	})
+}
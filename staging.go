@@ -0,0 +1,53 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stagingPolicy restricts the recipients for non-production environments
+type stagingPolicy struct {
+	allowed    []route // patterns of the allowed recipients, any recipient is allowed if empty
+	reject     bool    // fail the send with a recipient not allowed, instead of dropping the recipient
+	redirectTo string  // the only recipient of all the messages if set
+}
+
+// applyStaging filters the recipients by the allowlist and redirects them, as the policy says.
+// Redirected recipients are kept in params for X-Original-To header. Empty recipients with nil error mean
+// all of them were dropped.
+func (em *Sender) applyStaging(params Params) (Params, error) {
+	policy := em.staging
+	if len(policy.allowed) > 0 {
+		allowed, denied := []string{}, []string{}
+		for _, rcpt := range params.To {
+			if policy.allows(extractEmailAddress(rcpt)) {
+				allowed = append(allowed, rcpt)
+				continue
+			}
+			denied = append(denied, rcpt)
+		}
+		if len(denied) > 0 {
+			if policy.reject {
+				return params, fmt.Errorf("recipients not allowed: %s", strings.Join(denied, ", "))
+			}
+			em.logger.Logf("[INFO] recipients not allowed, dropped: %s", strings.Join(denied, ", "))
+			params.To = allowed
+		}
+	}
+
+	if policy.redirectTo != "" && len(params.To) > 0 {
+		em.logger.Logf("[DEBUG] redirect email to %v to %s", params.To, policy.redirectTo)
+		params.originalTo = params.To
+		params.To = []string{policy.redirectTo}
+	}
+	return params, nil
+}
+
+func (p stagingPolicy) allows(addr string) bool {
+	for _, r := range p.allowed {
+		if r.match(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_AllowRecipients(t *testing.T) {
+	params := Params{From: "from@example.com", Subject: "subj",
+		To: []string{"qa@example.com", "Customer <customer@gmail.com>", "dev@staging.example.com"}}
+
+	t.Run("drop", func(t *testing.T) {
+		client := newTestSMTPClient()
+		logBuff := bytes.NewBuffer(nil)
+		s := NewSender("localhost", SMTP(client), AllowRecipients(false, "QA@example.com", "*.example.com"),
+			Log(newTestLogger(logBuff)))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Equal(t, []RecipientStatus{{Address: "qa@example.com"}, {Address: "dev@staging.example.com"}}, res.Recipients)
+		require.Len(t, client.RcptCalls(), 2)
+		assert.Contains(t, logBuff.String(), "[INFO] recipients not allowed, dropped: Customer <customer@gmail.com>")
+	})
+
+	t.Run("all dropped", func(t *testing.T) {
+		client := newTestSMTPClient()
+		s := NewSender("localhost", SMTP(client), AllowRecipients(false, "example.org"))
+
+		res, err := s.Deliver(context.Background(), "test body", params)
+		require.NoError(t, err)
+		assert.Empty(t, res.Recipients)
+		assert.Empty(t, client.MailCalls())
+		assert.Len(t, client.CloseCalls(), 1)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		client := newTestSMTPClient()
+		s := NewSender("localhost", SMTP(client), AllowRecipients(true, "example.com"))
+
+		_, err := s.Deliver(context.Background(), "test body", params)
+		require.EqualError(t, err, "recipients not allowed: Customer <customer@gmail.com>, dev@staging.example.com")
+		assert.Empty(t, client.MailCalls())
+	})
+
+	t.Run("no recipients", func(t *testing.T) {
+		s := NewSender("localhost", SMTP(newTestSMTPClient()), AllowRecipients(false, "example.com"))
+		_, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com"})
+		require.EqualError(t, err, "no recipients")
+	})
+}
+
+func TestEmail_RedirectAll(t *testing.T) {
+	client := newTestSMTPClient()
+	wc := &fakeWriterCloser{buff: bytes.NewBuffer(nil)}
+	client.DataFunc = func() (io.WriteCloser, error) { return wc, nil }
+	s := NewSender("localhost", SMTP(client), AllowRecipients(false, "example.com", "example.org"),
+		RedirectAll("catch-all@qa.example.com"))
+
+	res, err := s.Deliver(context.Background(), "test body", Params{From: "from@example.com", Subject: "subj",
+		To: []string{"one@example.com", "Two <two@example.org>", "three@gmail.com"}})
+	require.NoError(t, err)
+	assert.Equal(t, []RecipientStatus{{Address: "catch-all@qa.example.com"}}, res.Recipients)
+	require.Len(t, client.RcptCalls(), 1)
+	assert.Equal(t, "catch-all@qa.example.com", client.RcptCalls()[0].To)
+	assert.Contains(t, wc.buff.String(), "\nTo: catch-all@qa.example.com\nX-Original-To: one@example.com,Two <two@example.org>\n")
+	assert.NotContains(t, wc.buff.String(), "three@gmail.com", "dropped by the allowlist before the redirect")
+
+	_, err = s.Deliver(context.Background(), "test body", Params{From: "from@example.com", To: []string{"one@example.com\r\nBcc: x@example.com"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid")
+}
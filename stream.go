@@ -0,0 +1,159 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// payload is the message the transaction writes to DATA, built in memory or, with Streaming, encoded while written
+type payload struct {
+	head  []byte       // the whole message built in memory, or the headers and the text of the streamed one
+	parts *streamParts // file parts of the streamed message, nil if the message is built in memory
+	size  int64        // size of the whole message, the streamed one included
+}
+
+// streamParts are the files of the streamed message, opened upfront and encoded into the parts on each write
+type streamParts struct {
+	boundaryRelated string
+	boundaryMixed   string
+	inline          []*os.File
+	attachments     []*os.File
+}
+
+// openStream builds the headers and the text of the message and opens all its files, so everything which can fail
+// before the connection fails here, size limits included. The files are encoded when the message is written.
+func (em *Sender) openStream(text string, params Params) (*payload, error) {
+	head, err := em.buildHead(text, params)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := openParts(head, params)
+	if err != nil {
+		return nil, err
+	}
+	msg := &payload{head: head.data.Bytes(), parts: parts}
+	if msg.size, err = em.checkSizeLimits(msg); err != nil {
+		msg.close(em.logger)
+		return nil, err
+	}
+	return msg, nil
+}
+
+// openParts opens the files of the message, none is left open on failure
+func openParts(head *messageHead, params Params) (parts *streamParts, err error) {
+	parts = &streamParts{boundaryRelated: head.boundaryRelated, boundaryMixed: head.boundaryMixed}
+	if parts.inline, err = openFiles(params.InlineImages); err != nil {
+		return nil, fmt.Errorf("failed to open inline images: %w", err)
+	}
+	if parts.attachments, err = openFiles(params.Attachments); err != nil {
+		_ = closeFiles(parts.inline)
+		return nil, fmt.Errorf("failed to open attachments: %w", err)
+	}
+	return parts, nil
+}
+
+// openFiles opens the files for reading, none is left open on failure
+func openFiles(names []string) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(names))
+	for _, name := range names {
+		if _, err := attachmentName(name); err != nil {
+			_ = closeFiles(files)
+			return nil, err
+		}
+		file, err := os.Open(filepath.Clean(name))
+		if err != nil {
+			_ = closeFiles(files)
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// closeFiles closes all the files, returning the first error
+func closeFiles(files []*os.File) (err error) {
+	for _, file := range files {
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// close closes the files of the streamed message, if any
+func (p *payload) close(logger Logger) {
+	if p == nil || p.parts == nil {
+		return
+	}
+	if err := closeFiles(append(p.parts.inline, p.parts.attachments...)); err != nil {
+		logger.Logf("[WARN] can't close message files, %v", err)
+	}
+}
+
+// writePayload writes the message to w. The streamed message is encoded in a goroutine through a pipe, and the copy
+// stops once ctx is done, with the encoder stopped before it returns.
+func (em *Sender) writePayload(ctx context.Context, w io.Writer, p *payload) error {
+	if p.parts == nil {
+		_, err := w.Write(p.head)
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = pw.CloseWithError(em.encodeMessage(pw, p))
+	}()
+	_, err := io.Copy(w, &ctxReader{ctx: ctx, r: pr})
+	_ = pr.CloseWithError(err) // stops the encoder if the copy failed, no-op after it finished
+	<-done                     // files are read by the next write, e.g. to the failover relay, or closed
+	return err
+}
+
+// encodeMessage writes the head and encodes the file parts of the streamed message to w
+func (em *Sender) encodeMessage(w io.Writer, p *payload) error {
+	if _, err := w.Write(p.head); err != nil {
+		return err
+	}
+	if len(p.parts.inline) > 0 {
+		if err := em.writeStreamParts(w, p.parts.boundaryRelated, p.parts.inline, "inline"); err != nil {
+			return fmt.Errorf("failed to write inline images: %w", err)
+		}
+	}
+	if len(p.parts.attachments) > 0 {
+		if err := em.writeStreamParts(w, p.parts.boundaryMixed, p.parts.attachments, "attachment"); err != nil {
+			return fmt.Errorf("failed to write attachments: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeStreamParts writes the parts of the open files, like writeFiles does for the ones it opens
+func (em *Sender) writeStreamParts(w io.Writer, boundary string, files []*os.File, disposition string) error {
+	if _, err := io.WriteString(w, "\r\n\r\n"); err != nil {
+		return err
+	}
+	mp := partsWriter(w, boundary)
+	for _, file := range files {
+		if err := em.writeFilePart(mp, file, disposition); err != nil {
+			return err
+		}
+	}
+	return mp.Close()
+}
+
+// ctxReader fails the reads once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
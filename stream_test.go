@@ -0,0 +1,162 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/email/mocks"
+)
+
+func TestEmail_SendStreaming(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "streamed",
+		Attachments: []string{"testdata/1.txt", "testdata/nullfile", "testdata/image.jpg"}, InlineImages: []string{"testdata/image.jpg"}}
+	data := bytes.NewBuffer(nil)
+	client := newTestSMTPClient()
+	client.DataFunc = func() (io.WriteCloser, error) { return &fakeWriterCloser{buff: data}, nil }
+
+	s := NewSender("localhost", SMTP(client), ContentType("text/html"), Streaming(true))
+	s.timeNow = func() time.Time { return time.Date(2022, time.February, 10, 23, 33, 58, 0, time.UTC) }
+	require.NoError(t, s.Send("<img src=\"cid:image.jpg\">", params))
+
+	streamed, err := ParseMessage(data)
+	require.NoError(t, err)
+	built, err := s.BuildMessage("<img src=\"cid:image.jpg\">", params)
+	require.NoError(t, err)
+	expected, err := ParseMessage(built.Reader())
+	require.NoError(t, err)
+	streamed.Header, expected.Header = nil, nil // boundaries differ
+	assert.Equal(t, expected, streamed, "the same message as the one built in memory")
+	require.Len(t, streamed.Attachments, 3)
+	assert.Empty(t, streamed.Attachments[1].Data)
+}
+
+func TestEmail_SendStreamingOpensFilesUpfront(t *testing.T) {
+	dialed := false
+	s := NewSender("localhost", Streaming(true), DialContext(func(context.Context, string, string) (net.Conn, error) {
+		dialed = true
+		return nil, errors.New("refused")
+	}))
+
+	err := s.Send("text", Params{From: "from@example.com", To: []string{"to@example.com"},
+		Attachments: []string{"testdata/1.txt", "testdata/no-such-file.txt"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't make email message: failed to open attachments: open testdata/no-such-file.txt")
+	assert.False(t, dialed, "nothing sent with a file missing")
+
+	err = s.Send("text", Params{From: "from@example.com", To: []string{"to@example.com"},
+		InlineImages: []string{"testdata/bad\nname.jpg"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open inline images: invalid file name")
+	assert.False(t, dialed)
+}
+
+func TestEmail_SendStreamingFailover(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "big.bin")
+	require.NoError(t, os.WriteFile(file, bytes.Repeat([]byte("0123456789"), 100_000), 0o600))
+
+	var sent []*bytes.Buffer
+	newRelay := func(dataErr error, opts ...Option) *Sender {
+		client := newTestSMTPClient()
+		client.DataFunc = func() (io.WriteCloser, error) {
+			buff := bytes.NewBuffer(nil)
+			sent = append(sent, buff)
+			return &fakeWriterCloser{buff: buff, closeErr: dataErr}, nil
+		}
+		return NewSender("localhost", append(opts, SMTP(client), Streaming(true))...)
+	}
+	s := newRelay(&textproto.Error{Code: 421, Msg: "busy"}, Failover(time.Minute, newRelay(nil)))
+
+	require.NoError(t, s.Send("text", Params{From: "from@example.com", To: []string{"to@example.com"}, Attachments: []string{file}}))
+	require.Len(t, sent, 2)
+	assert.Greater(t, sent[1].Len(), 1_000_000)
+	assert.Equal(t, sent[0].String(), sent[1].String(), "the files are read again from the beginning")
+}
+
+func TestEmail_SendStreamingCanceled(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "big.bin")
+	require.NoError(t, os.WriteFile(file, make([]byte, 10_000_000), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newTestSMTPClient()
+	written := 0
+	client.DataFunc = func() (io.WriteCloser, error) {
+		return &callbackWriter{write: func(p []byte) {
+			written += len(p)
+			if written > 100_000 {
+				cancel() // in the middle of the attachment
+			}
+		}}, nil
+	}
+
+	s := NewSender("localhost", SMTP(client), Streaming(true))
+	err := s.SendContext(ctx, "text", Params{From: "from@example.com", To: []string{"to@example.com"}, Attachments: []string{file}})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Contains(t, err.Error(), "failed to send email body")
+	assert.Less(t, written, 1_000_000, "stopped soon after the cancel")
+}
+
+func TestEmail_SendStreamingMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocates a large file")
+	}
+	const size = 5_000_000
+	file := filepath.Join(t.TempDir(), "big.bin")
+	require.NoError(t, os.WriteFile(file, make([]byte, size), 0o600))
+
+	allocated := func(opts ...Option) uint64 {
+		client := newTestSMTPClient()
+		client.DataFunc = func() (io.WriteCloser, error) { return &callbackWriter{}, nil }
+		s := NewSender("localhost", append(opts, SMTP(client))...)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		require.NoError(t, s.Send("text", Params{From: "from@example.com", To: []string{"to@example.com"}, Attachments: []string{file}}))
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	assert.Greater(t, allocated(), uint64(size), "built in memory, base64 of the file at least")
+	assert.Less(t, allocated(Streaming(true)), uint64(size/10), "streamed")
+}
+
+func TestEmail_DryRunStreaming(t *testing.T) {
+	params := Params{From: "from@example.com", To: []string{"to@example.com"}, Attachments: []string{"testdata/1.txt"}}
+	built, err := NewSender("localhost").BuildMessage("text", params)
+	require.NoError(t, err)
+
+	logBuff := bytes.NewBuffer(nil)
+	client := &mocks.SMTPClientMock{CloseFunc: func() error { return nil }}
+	s := NewSender("localhost", SMTP(client), Streaming(true), DryRun(true), Log(newTestLogger(logBuff)))
+	res, err := s.Deliver(context.Background(), "text", params)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:25", res.Relay)
+	assert.Empty(t, client.MailCalls())
+	assert.Contains(t, logBuff.String(), fmt.Sprintf("built, %d bytes, not sent", len(built.Data)), "size of the encoded message")
+}
+
+// callbackWriter drops the data written, calling write with it first
+type callbackWriter struct {
+	write func([]byte)
+}
+
+func (w *callbackWriter) Write(p []byte) (int, error) {
+	if w.write != nil {
+		w.write(p)
+	}
+	return len(p), nil
+}
+
+func (w *callbackWriter) Close() error { return nil }
@@ -0,0 +1,210 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// StartTLSPolicy defines when a plain connection is upgraded to TLS with STARTTLS
+type StartTLSPolicy int
+
+// List of STARTTLS policies
+const (
+	StartTLSNever         StartTLSPolicy = iota // never upgrade, the default
+	StartTLSOpportunistic                       // upgrade if the server advertises STARTTLS, stay plain otherwise
+	StartTLSRequired                            // upgrade or fail before AUTH and MAIL if the server doesn't advertise STARTTLS
+)
+
+// String returns the policy name
+func (p StartTLSPolicy) String() string {
+	switch p {
+	case StartTLSNever:
+		return "never"
+	case StartTLSOpportunistic:
+		return "opportunistic"
+	case StartTLSRequired:
+		return "required"
+	}
+	return fmt.Sprintf("StartTLSPolicy(%d)", int(p))
+}
+
+// startTLS upgrades the greeted connection to TLS as the STARTTLS policy says.
+// Nothing is sent to a server not advertising STARTTLS, the required policy fails right away,
+// this way a stripped STARTTLS extension doesn't downgrade the connection to a plain one.
+// Returns the client to go on with, a new one if the connection is recorded for the transcript.
+func (em *Sender) startTLS(ctx context.Context, c *smtp.Client, conn net.Conn, conf *tls.Config) (*smtp.Client, error) {
+	if em.starttls == StartTLSNever {
+		return c, nil
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if em.starttls == StartTLSRequired {
+			return nil, fmt.Errorf("failed to start tls: STARTTLS required, but not advertised by %s:%d", em.host, em.port)
+		}
+		em.logger.Logf("[WARN] STARTTLS not advertised by %s:%d, continue without tls", em.host, em.port)
+		return c, nil
+	}
+	start := time.Now()
+	if tc, ok := conn.(*transcriptConn); ok {
+		upgraded, err := em.startTLSRecorded(c, tc, conf)
+		em.observe(ctx, PhaseTLS, start, err)
+		return upgraded, err
+	}
+	err := c.StartTLS(conf)
+	em.observe(ctx, PhaseTLS, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start tls: %w", err)
+	}
+	return c, nil
+}
+
+// tlsConfig makes the configuration used for both implicit TLS and STARTTLS connections.
+// Client certificate files are loaded on each call, this way a renewed certificate is picked up without a restart.
+func (em *Sender) tlsConfig() (*tls.Config, error) {
+	conf := em.baseTLSConfig()
+
+	if em.clientCertFile != "" || em.clientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(em.clientCertFile, em.clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(em.tlsPins) > 0 {
+		pins, err := parseSPKIPins(em.tlsPins)
+		if err != nil {
+			return nil, err
+		}
+		conf.VerifyConnection = verifySPKIPins(pins, conf.VerifyConnection)
+	}
+	return conf, nil
+}
+
+// baseTLSConfig makes the configuration from TLSConfig, if set, and the TLS options applied on top of it.
+// It has nothing which can fail, which is loaded or checked in tlsConfig, and is used to describe the policy as well.
+func (em *Sender) baseTLSConfig() *tls.Config {
+	conf := &tls.Config{} // #nosec G402, the min version is set below
+	if em.customTLS != nil {
+		conf = em.customTLS.Clone() // never modify the caller's config, it can be shared
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = em.host
+	}
+	if conf.MinVersion == 0 {
+		conf.MinVersion = tls.VersionTLS12
+	}
+	if em.insecureSkipVerify {
+		conf.InsecureSkipVerify = true // #nosec G402
+	}
+	if em.rootCAs != nil {
+		conf.RootCAs = em.rootCAs
+	}
+	if em.getClientCert != nil {
+		conf.GetClientCertificate = em.getClientCert // takes precedence over Certificates if both set
+	}
+	return conf
+}
+
+// tlsPolicy describes the effective TLS settings for String, with no keys or file names in it
+func (em *Sender) tlsPolicy() string {
+	if !em.tls && em.starttls == StartTLSNever {
+		return "none"
+	}
+	conf := em.baseTLSConfig()
+
+	verify := "system-roots"
+	switch {
+	case conf.InsecureSkipVerify:
+		verify = "skipped"
+	case conf.RootCAs != nil:
+		verify = "custom-roots"
+	}
+
+	clientCert := "none"
+	switch {
+	case conf.GetClientCertificate != nil:
+		clientCert = "callback"
+	case em.clientCertFile != "" || len(conf.Certificates) > 0:
+		clientCert = "static"
+	}
+
+	ciphers := "default"
+	if len(conf.CipherSuites) > 0 {
+		names := make([]string, 0, len(conf.CipherSuites))
+		for _, id := range conf.CipherSuites {
+			names = append(names, tls.CipherSuiteName(id))
+		}
+		ciphers = strings.Join(names, "|")
+	}
+
+	return fmt.Sprintf("{min:%s, verify:%s, server-name:%q, client-cert:%s, pins:%d, ciphers:%s}",
+		tlsVersionName(conf.MinVersion), verify, conf.ServerName, clientCert, len(em.tlsPins), ciphers)
+}
+
+// tlsVersionName returns the name of TLS version, tls.VersionName is not available before go 1.21
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// parseSPKIPins decodes base64 SHA-256 hashes of certificate public keys, with optional "sha256/" prefix
+func parseSPKIPins(pins []string) ([][]byte, error) {
+	res := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q, base64 encoded SHA-256 hash expected", pin)
+		}
+		res = append(res, hash)
+	}
+	return res, nil
+}
+
+// verifySPKIPins makes tls.Config.VerifyConnection function accepting the server only if its certificate chain
+// has a pinned public key. It runs after the usual verification, if not skipped, and after next, if set.
+// Only the verified chains are checked, the server can send any certificates after its own, e.g. the pinned one
+// it doesn't have the key of. With the verification skipped only the server's own certificate is checked.
+func verifySPKIPins(pins [][]byte, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		var certs []*x509.Certificate
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+		for _, cert := range certs {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errors.New("server certificate doesn't match any pinned SPKI hash")
+	}
+}
@@ -0,0 +1,544 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSender_tlsConfig(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeTestCertificate(t, ca.issue(t, "client.example.net", x509.ExtKeyUsageClientAuth))
+
+	t.Run("defaults", func(t *testing.T) {
+		conf, err := NewSender("smtp.example.net", TLS(true)).tlsConfig()
+		require.NoError(t, err)
+		assert.Equal(t, "smtp.example.net", conf.ServerName)
+		assert.Equal(t, uint16(tls.VersionTLS12), conf.MinVersion)
+		assert.False(t, conf.InsecureSkipVerify)
+		assert.Nil(t, conf.RootCAs)
+		assert.Empty(t, conf.Certificates)
+		assert.Nil(t, conf.GetClientCertificate)
+	})
+
+	t.Run("client certificate and root CAs", func(t *testing.T) {
+		conf, err := NewSender("smtp.example.net", TLS(true), ClientCertificate(certFile, keyFile), RootCAs(ca.pool)).tlsConfig()
+		require.NoError(t, err)
+		require.Len(t, conf.Certificates, 1)
+		leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		assert.Equal(t, "client.example.net", leaf.Subject.CommonName)
+		assert.Same(t, ca.pool, conf.RootCAs)
+	})
+
+	t.Run("bad client certificate", func(t *testing.T) {
+		_, err := NewSender("smtp.example.net", TLS(true), ClientCertificate(certFile, "does/not/exist.pem")).tlsConfig()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't load client certificate")
+
+		// a broken certificate fails the connection attempt, not just the configuration
+		s := NewSender("127.0.0.1", Port(1), STARTTLS(true), ClientCertificate("does/not/exist.pem", keyFile))
+		_, _, err = s.client(context.Background(), nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't load client certificate")
+	})
+}
+
+func TestEmail_ClientMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	clientCert := ca.issue(t, "client.example.net", x509.ExtKeyUsageClientAuth)
+
+	// implicit TLS server checking the client certificate subject, stops after the greeting
+	tlsServer := func(t *testing.T) (host string, port int, done <-chan error) {
+		return startSMTPTestServer(t, func(conn net.Conn) error {
+			tlsConn := tls.Server(conn, serverTLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return err
+			}
+			if err := checkTestPeerCertificate(tlsConn, "client.example.net"); err != nil {
+				return err
+			}
+			if err := writeSMTPResponse(tlsConn, "220 smtp.example.net ESMTP ready"); err != nil {
+				return err
+			}
+			reader := bufio.NewReader(tlsConn)
+			if _, err := readSMTPCommand(reader); err != nil {
+				return err
+			}
+			if err := writeSMTPResponse(tlsConn, "250 smtp.example.net"); err != nil {
+				return err
+			}
+			return expectSMTPQuit(tlsConn, reader)
+		})
+	}
+
+	t.Run("certificate files", func(t *testing.T) {
+		host, port, done := tlsServer(t)
+		certFile, keyFile := writeTestCertificate(t, clientCert)
+		s := NewSender(host, Port(port), TLS(true), RootCAs(ca.pool), ClientCertificate(certFile, keyFile),
+			HELOHost("client.example.net"))
+		client, _, err := s.client(context.Background(), nil)
+		require.NoError(t, err)
+		require.NoError(t, client.Quit())
+		waitSMTPTestServer(t, done)
+	})
+
+	t.Run("certificate callback", func(t *testing.T) {
+		host, port, done := tlsServer(t)
+		var called bool
+		s := NewSender(host, Port(port), TLS(true), RootCAs(ca.pool), HELOHost("client.example.net"),
+			GetClientCertificate(func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				called = true
+				return &clientCert, nil
+			}))
+		client, _, err := s.client(context.Background(), nil)
+		require.NoError(t, err)
+		require.NoError(t, client.Quit())
+		waitSMTPTestServer(t, done)
+		assert.True(t, called)
+	})
+
+	t.Run("server signed by unknown CA", func(t *testing.T) {
+		host, port, _ := startSMTPTestServer(t, func(conn net.Conn) error {
+			return tls.Server(conn, serverTLS).Handshake()
+		})
+		s := NewSender(host, Port(port), TLS(true), RootCAs(newTestCA(t).pool), TimeOut(time.Second))
+		_, _, err := s.client(context.Background(), nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "certificate signed by unknown authority")
+	})
+}
+
+func TestEmail_SendSTARTTLSExternalAuth(t *testing.T) {
+	ca := newTestCA(t)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+		if err := writeSMTPResponse(conn, "220 smtp.example.net ESMTP ready"); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		if _, err := readSMTPCommand(reader); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(conn, "250-smtp.example.net\r\n250 STARTTLS\r\n"); err != nil {
+			return err
+		}
+		if cmd, err := readSMTPCommand(reader); err != nil || cmd != "STARTTLS" {
+			return fmt.Errorf("unexpected command %q, %v", cmd, err)
+		}
+		if err := writeSMTPResponse(conn, "220 ready for TLS"); err != nil {
+			return err
+		}
+		tlsConn := tls.Server(conn, serverTLS)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		if err := checkTestPeerCertificate(tlsConn, "client.example.net"); err != nil {
+			return err
+		}
+		reader = bufio.NewReader(tlsConn)
+		if _, err := readSMTPCommand(reader); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tlsConn, "250-smtp.example.net\r\n250 AUTH EXTERNAL\r\n"); err != nil {
+			return err
+		}
+		if cmd, err := readSMTPCommand(reader); err != nil || cmd != "AUTH EXTERNAL" {
+			return fmt.Errorf("unexpected auth command %q, %v", cmd, err)
+		}
+		if err := writeSMTPResponse(tlsConn, "334 "); err != nil {
+			return err
+		}
+		if resp, err := readSMTPCommand(reader); err != nil || resp != "" {
+			return fmt.Errorf("unexpected auth response %q, %v", resp, err)
+		}
+		if err := writeSMTPResponse(tlsConn, "235 authenticated"); err != nil {
+			return err
+		}
+		if cmd, err := readSMTPCommand(reader); err != nil || cmd != "MAIL FROM:<from@example.com>" {
+			return fmt.Errorf("unexpected command %q, %v", cmd, err)
+		}
+		return writeSMTPResponse(tlsConn, "530 stop here")
+	})
+
+	certFile, keyFile := writeTestCertificate(t, ca.issue(t, "client.example.net", x509.ExtKeyUsageClientAuth))
+	s := NewSender(host, Port(port), STARTTLS(true), RootCAs(ca.pool), ClientCertificate(certFile, keyFile),
+		ExternalAuth(""), TimeOut(time.Second*5))
+	err := s.Send("test body", Params{From: "from@example.com", To: []string{"to@example.com"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stop here", "auth passed, the transaction went on to MAIL")
+	waitSMTPTestServer(t, done)
+}
+
+// testCA is a self-signed certificate authority issuing certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue makes a certificate for the given name, an IP address name goes to IP SANs and the rest to DNS SANs
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// withTestCertificate returns the certificate with the extra ones sent after it, as the server can do
+func withTestCertificate(cert tls.Certificate, extra ...[]byte) tls.Certificate {
+	cert.Certificate = append(append([][]byte{}, cert.Certificate...), extra...)
+	return cert
+}
+
+// writeTestCertificate saves the certificate and its key as PEM files, returns their paths
+func writeTestCertificate(t *testing.T, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	return certFile, keyFile
+}
+
+func checkTestPeerCertificate(conn *tls.Conn, wantSubject string) error {
+	peers := conn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return errors.New("no client certificate")
+	}
+	if peers[0].Subject.CommonName != wantSubject {
+		return fmt.Errorf("unexpected client certificate %q", peers[0].Subject.CommonName)
+	}
+	return nil
+}
+
+func TestSender_tlsConfigCustom(t *testing.T) {
+	ca := newTestCA(t)
+	base := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		ServerName:   "smtp.example.net",
+		RootCAs:      ca.pool,
+	}
+
+	conf, err := NewSender("192.0.2.1", TLS(true), TLSConfig(base)).tlsConfig()
+	require.NoError(t, err)
+	assert.NotSame(t, base, conf, "caller's config is cloned")
+	assert.Equal(t, uint16(tls.VersionTLS13), conf.MinVersion)
+	assert.Equal(t, base.CipherSuites, conf.CipherSuites)
+	assert.Equal(t, "smtp.example.net", conf.ServerName, "explicit server name kept")
+	assert.Same(t, ca.pool, conf.RootCAs)
+
+	other := newTestCA(t)
+	conf, err = NewSender("192.0.2.1", TLS(true), TLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}), RootCAs(other.pool),
+		InsecureSkipVerify(true), PinSPKI(testSPKIPin(t, ca.cert.Raw))).tlsConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", conf.ServerName, "host used with no server name set")
+	assert.Same(t, other.pool, conf.RootCAs, "options applied on top of the config")
+	assert.True(t, conf.InsecureSkipVerify)
+	assert.NotNil(t, conf.VerifyConnection)
+
+	_, err = NewSender("localhost", TLS(true), PinSPKI("not a pin")).tlsConfig()
+	require.EqualError(t, err, `invalid SPKI pin "not a pin", base64 encoded SHA-256 hash expected`)
+	_, err = NewSender("localhost", TLS(true), PinSPKI("c2hvcnQ=")).tlsConfig()
+	require.Error(t, err, "valid base64, but not a SHA-256 hash")
+}
+
+func TestEmail_ClientTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "smtp.example.net", x509.ExtKeyUsageServerAuth)
+	otherCert := ca.issue(t, "smtp.example.net", x509.ExtKeyUsageServerAuth) // trusted too, with another key
+
+	tests := []struct {
+		name    string
+		server  *tls.Config
+		options []Option
+		wantErr string
+	}{
+		{
+			name:    "server name override for an IP connection",
+			server:  &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12},
+			options: []Option{TLSConfig(&tls.Config{ServerName: "smtp.example.net", RootCAs: ca.pool})},
+		},
+		{
+			name:    "IP connection with no server name override",
+			server:  &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12},
+			options: []Option{RootCAs(ca.pool)},
+			wantErr: "doesn't contain any IP SANs",
+		},
+		{
+			name:   "min version above the server's",
+			server: &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12},
+			options: []Option{TLSConfig(&tls.Config{ServerName: "smtp.example.net", RootCAs: ca.pool,
+				MinVersion: tls.VersionTLS13})},
+			wantErr: "protocol version",
+		},
+		{
+			name:   "pinned server key",
+			server: &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12},
+			options: []Option{TLSConfig(&tls.Config{ServerName: "smtp.example.net", RootCAs: ca.pool}),
+				PinSPKI("sha256/" + testSPKIPin(t, serverCert.Certificate[0]))},
+		},
+		{
+			name:    "pinned key with verification skipped",
+			server:  &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12},
+			options: []Option{InsecureSkipVerify(true), PinSPKI(testSPKIPin(t, serverCert.Certificate[0]))},
+		},
+		{
+			name:   "pinned CA key",
+			server: &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12},
+			options: []Option{TLSConfig(&tls.Config{ServerName: "smtp.example.net", RootCAs: ca.pool}),
+				PinSPKI(testSPKIPin(t, ca.cert.Raw))},
+		},
+		{
+			name: "pinned certificate appended after another one, verification skipped",
+			server: &tls.Config{Certificates: []tls.Certificate{withTestCertificate(otherCert, serverCert.Certificate[0])},
+				MinVersion: tls.VersionTLS12},
+			options: []Option{InsecureSkipVerify(true), PinSPKI(testSPKIPin(t, serverCert.Certificate[0]))},
+			wantErr: "doesn't match any pinned SPKI hash",
+		},
+		{
+			name: "pinned certificate appended after another trusted one",
+			server: &tls.Config{Certificates: []tls.Certificate{withTestCertificate(otherCert, serverCert.Certificate[0])},
+				MinVersion: tls.VersionTLS12},
+			options: []Option{TLSConfig(&tls.Config{ServerName: "smtp.example.net", RootCAs: ca.pool}),
+				PinSPKI(testSPKIPin(t, serverCert.Certificate[0]))},
+			wantErr: "doesn't match any pinned SPKI hash",
+		},
+		{
+			name:    "pin mismatch",
+			server:  &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12},
+			options: []Option{InsecureSkipVerify(true), PinSPKI(testSPKIPin(t, ca.cert.Raw))},
+			wantErr: "doesn't match any pinned SPKI hash",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+				tlsConn := tls.Server(conn, tt.server)
+				if err := tlsConn.Handshake(); err != nil {
+					return nil // failed handshake is checked on the client side
+				}
+				if err := writeSMTPResponse(tlsConn, "220 smtp.example.net ESMTP ready"); err != nil {
+					return err
+				}
+				reader := bufio.NewReader(tlsConn)
+				if _, err := readSMTPCommand(reader); err != nil {
+					return err
+				}
+				if err := writeSMTPResponse(tlsConn, "250 smtp.example.net"); err != nil {
+					return err
+				}
+				return expectSMTPQuit(tlsConn, reader)
+			})
+
+			s := NewSender(host, append([]Option{Port(port), TLS(true), HELOHost("client.example.net")}, tt.options...)...)
+			client, _, err := s.client(context.Background(), nil)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, client.Quit())
+			waitSMTPTestServer(t, done)
+		})
+	}
+}
+
+func TestSender_tlsPolicy(t *testing.T) {
+	assert.Equal(t, "none", NewSender("localhost").tlsPolicy())
+
+	assert.Equal(t, `{min:TLS1.2, verify:system-roots, server-name:"localhost", client-cert:none, pins:0, ciphers:default}`,
+		NewSender("localhost", STARTTLS(true)).tlsPolicy())
+
+	s := NewSender("192.0.2.1", TLS(true), ClientCertificate("secret/cert.pem", "secret/key.pem"), PinSPKI("a", "b"),
+		TLSConfig(&tls.Config{MinVersion: tls.VersionTLS13, ServerName: "smtp.example.net", RootCAs: x509.NewCertPool(),
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}))
+	assert.Equal(t, `{min:TLS1.3, verify:custom-roots, server-name:"smtp.example.net", client-cert:static, pins:2, `+
+		`ciphers:TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256|TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}`, s.tlsPolicy())
+	assert.NotContains(t, s.String(), "secret", "no file names in the description")
+
+	s = NewSender("localhost", TLS(true), GetClientCertificate(func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return nil, nil
+	}))
+	assert.Contains(t, s.tlsPolicy(), "client-cert:callback")
+}
+
+// testSPKIPin returns the base64 SHA-256 hash of the public key of DER encoded certificate
+func testSPKIPin(t *testing.T, der []byte) string {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestEmail_ClientSTARTTLSPolicy(t *testing.T) {
+	serverTLS := smtpTestTLSConfig(t)
+
+	tests := []struct {
+		name       string
+		policy     StartTLSPolicy
+		advertised bool
+		wantTLS    bool
+		wantErr    string
+	}{
+		{name: "never, advertised", policy: StartTLSNever, advertised: true},
+		{name: "never, not advertised", policy: StartTLSNever},
+		{name: "opportunistic, advertised", policy: StartTLSOpportunistic, advertised: true, wantTLS: true},
+		{name: "opportunistic, not advertised", policy: StartTLSOpportunistic},
+		{name: "required, advertised", policy: StartTLSRequired, advertised: true, wantTLS: true},
+		{name: "required, not advertised", policy: StartTLSRequired, wantErr: "STARTTLS required, but not advertised"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+				if err := writeSMTPResponse(conn, "220 smtp.example.net ESMTP ready"); err != nil {
+					return err
+				}
+				reader := bufio.NewReader(conn)
+				if _, err := readSMTPCommand(reader); err != nil {
+					return err
+				}
+				ehloResponse := "250 smtp.example.net\r\n"
+				if tt.advertised {
+					ehloResponse = "250-smtp.example.net\r\n250 STARTTLS\r\n"
+				}
+				if _, err := io.WriteString(conn, ehloResponse); err != nil {
+					return err
+				}
+				if tt.wantErr != "" {
+					return expectSMTPConnectionClosed(conn, reader) // nothing sent to the server
+				}
+
+				var rw net.Conn = conn
+				if tt.wantTLS {
+					if cmd, err := readSMTPCommand(reader); err != nil || cmd != "STARTTLS" {
+						return fmt.Errorf("unexpected command %q, %v", cmd, err)
+					}
+					if err := writeSMTPResponse(conn, "220 ready for TLS"); err != nil {
+						return err
+					}
+					tlsConn := tls.Server(conn, serverTLS)
+					if err := tlsConn.Handshake(); err != nil {
+						return err
+					}
+					rw, reader = tlsConn, bufio.NewReader(tlsConn)
+					if _, err := readSMTPCommand(reader); err != nil {
+						return err
+					}
+					if err := writeSMTPResponse(rw, "250 smtp.example.net"); err != nil {
+						return err
+					}
+				}
+				if cmd, err := readSMTPCommand(reader); err != nil || cmd != "MAIL FROM:<from@example.com>" {
+					return fmt.Errorf("unexpected command %q, %v", cmd, err)
+				}
+				if err := writeSMTPResponse(rw, "250 ok"); err != nil {
+					return err
+				}
+				return expectSMTPQuit(rw, reader)
+			})
+
+			s := NewSender(host, Port(port), STARTTLSPolicy(tt.policy), InsecureSkipVerify(true))
+			client, _, err := s.client(context.Background(), nil)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				waitSMTPTestServer(t, done)
+				return
+			}
+			require.NoError(t, err)
+			_, isTLS := client.TLSConnectionState()
+			assert.Equal(t, tt.wantTLS, isTLS)
+			require.NoError(t, client.Mail("from@example.com"))
+			require.NoError(t, client.Quit())
+			waitSMTPTestServer(t, done)
+		})
+	}
+}
+
+func TestStartTLSPolicy_String(t *testing.T) {
+	assert.Equal(t, "never", StartTLSNever.String())
+	assert.Equal(t, "opportunistic", StartTLSOpportunistic.String())
+	assert.Equal(t, "required", StartTLSRequired.String())
+	assert.Equal(t, "StartTLSPolicy(42)", StartTLSPolicy(42).String())
+	assert.Equal(t, StartTLSRequired, NewSender("localhost", STARTTLS(true)).starttls)
+	assert.Equal(t, StartTLSNever, NewSender("localhost", STARTTLS(true), STARTTLS(false)).starttls)
+}
@@ -0,0 +1,240 @@
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// TranscriptMode sets where the SMTP transcript goes, the modes can be combined with |
+type TranscriptMode int
+
+// transcript modes
+const (
+	TranscriptToLog   TranscriptMode = 1 << iota // logged at debug level after each transaction
+	TranscriptToError                            // attached to the returned error as *TranscriptError
+)
+
+// TranscriptError is the failed send along with the SMTP conversation which led to it
+type TranscriptError struct {
+	Err        error
+	Transcript string // "C: " lines sent by the client and "S: " lines by the server, AUTH and message data redacted
+}
+
+func (e *TranscriptError) Error() string {
+	return fmt.Sprintf("%v, smtp transcript:\n%s", e.Err, e.Transcript)
+}
+
+func (e *TranscriptError) Unwrap() error { return e.Err }
+
+// transcript records the SMTP conversation going through transcriptConn
+type transcript struct {
+	mu        sync.Mutex
+	lines     []string
+	client    []byte // incomplete lines
+	server    []byte
+	inAuth    bool // AUTH exchange is in progress, client lines are credentials
+	inData    bool // message data is being sent
+	dataBytes int
+	tls       bool // connection is encrypted, net/smtp can't tell as it doesn't see *tls.Conn
+}
+
+// newTranscript makes the transcript recorder if the sender captures it, nil otherwise
+func (em *Sender) newTranscript() *transcript {
+	if em.transcript == 0 {
+		return nil
+	}
+	return &transcript{}
+}
+
+// reportTranscript logs the transcript and attaches it to the error, as the mode says
+func (em *Sender) reportTranscript(rec *transcript, err error) error {
+	if rec == nil {
+		return err
+	}
+	text := em.redact(rec.String())
+	if text == "" { // client set with the SMTP option, nothing recorded
+		return err
+	}
+	if em.transcript&TranscriptToLog != 0 {
+		_, addr := em.serverAddress()
+		em.logger.Logf("[DEBUG] smtp transcript of %s:\n%s", addr, text)
+	}
+	if err != nil && em.transcript&TranscriptToError != 0 {
+		return &TranscriptError{Err: err, Transcript: text}
+	}
+	return err
+}
+
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+func (t *transcript) note(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, "-- "+line)
+}
+
+// clientWrite records the complete lines sent by the client
+func (t *transcript) clientWrite(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.client = append(t.client, p...)
+	for {
+		i := bytes.IndexByte(t.client, '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimSuffix(string(t.client[:i]), "\r")
+		t.client = t.client[i+1:]
+		t.clientLine(line)
+	}
+}
+
+func (t *transcript) clientLine(line string) {
+	switch {
+	case t.inData && line == ".":
+		t.lines = append(t.lines, fmt.Sprintf("C: [message data, %d bytes]", t.dataBytes), "C: .")
+		t.inData, t.dataBytes = false, 0
+	case t.inData:
+		t.dataBytes += len(line) + 2
+	case t.inAuth:
+		t.lines = append(t.lines, "C: "+redacted)
+	case len(line) >= 5 && strings.EqualFold(line[:5], "AUTH "):
+		t.inAuth = true
+		if fields := strings.Fields(line); len(fields) > 2 { // initial response has the credentials
+			line = fields[0] + " " + fields[1] + " " + redacted
+		}
+		t.lines = append(t.lines, "C: "+line)
+	default:
+		t.lines = append(t.lines, "C: "+line)
+	}
+}
+
+// serverRead records the complete lines sent by the server
+func (t *transcript) serverRead(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.server = append(t.server, p...)
+	for {
+		i := bytes.IndexByte(t.server, '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimSuffix(string(t.server[:i]), "\r")
+		t.server = t.server[i+1:]
+		t.lines = append(t.lines, "S: "+line)
+		if t.inAuth && !strings.HasPrefix(line, "334") {
+			t.inAuth = false
+		}
+		if strings.HasPrefix(line, "354") {
+			t.inData = true
+		}
+	}
+}
+
+// transcriptConn records the conversation going through the connection
+type transcriptConn struct {
+	net.Conn
+	rec      *transcript
+	greeting []byte // synthetic server greeting for the client made after STARTTLS, not recorded
+}
+
+func newTranscriptConn(conn net.Conn, rec *transcript) *transcriptConn {
+	_, rec.tls = conn.(*tls.Conn)
+	return &transcriptConn{Conn: conn, rec: rec}
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(p, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	c.rec.serverRead(p[:n])
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	c.rec.clientWrite(p)
+	return c.Conn.Write(p)
+}
+
+// isTLSConn checks if the connection is encrypted, looking under the transcript recorder
+func isTLSConn(conn net.Conn) bool {
+	if tc, ok := conn.(*transcriptConn); ok {
+		tc.rec.mu.Lock()
+		defer tc.rec.mu.Unlock()
+		return tc.rec.tls
+	}
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// startTLSRecorded upgrades the connection under the transcript recorder, this way the commands after STARTTLS
+// are recorded in plain text. net/smtp would put TLS above the recorder, so the upgrade is made here instead,
+// and the new client greets the server again, as net/smtp does after its own STARTTLS.
+// Errors are wrapped the same way as the ones of smtp.Client.StartTLS in startTLS.
+func (em *Sender) startTLSRecorded(c *smtp.Client, tc *transcriptConn, conf *tls.Config) (*smtp.Client, error) {
+	id, err := c.Text.Cmd("STARTTLS")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start tls: %w", err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(220)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start tls: %w", err)
+	}
+
+	tlsConn := tls.Client(tc.Conn, conf)
+	if err = tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("failed to start tls: %w", err)
+	}
+	tc.Conn, tc.greeting = tlsConn, []byte("220 "+em.host+"\r\n")
+	tc.rec.mu.Lock()
+	tc.rec.tls = true
+	tc.rec.mu.Unlock()
+	tc.rec.note(fmt.Sprintf("[TLS started, %s]", tlsVersionName(tlsConn.ConnectionState().Version)))
+
+	upgraded, err := smtp.NewClient(tc, em.host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start tls: %w", err)
+	}
+	if err = em.hello(upgraded); err != nil {
+		return nil, fmt.Errorf("failed to start tls: %w", err)
+	}
+	return upgraded, nil
+}
+
+// tlsStateAuth tells the auth the connection is encrypted, net/smtp doesn't know it with the transcript recorder
+type tlsStateAuth struct {
+	smtp.Auth
+}
+
+func (a tlsStateAuth) Start(server *smtp.ServerInfo) (proto string, toServer []byte, err error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+// authTLSState wraps the auth with tlsStateAuth if the recorded connection is encrypted
+func (t *transcript) authTLSState(auth smtp.Auth) smtp.Auth {
+	if t == nil || auth == nil {
+		return auth
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.tls {
+		return auth
+	}
+	return tlsStateAuth{Auth: auth}
+}
@@ -0,0 +1,210 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_TranscriptToError(t *testing.T) {
+	host, port, done := startSMTPTestServer(t, transcriptTestHandler(nil, []transcriptTestStep{
+		{"EHLO localhost", "250-smtp.example.net\r\n250 AUTH PLAIN"},
+		{"AUTH PLAIN ", "235 accepted"},
+		{"MAIL FROM:<from@example.com>", "250 ok"},
+		{"RCPT TO:<to@example.com>", "550 no such user here"},
+	}))
+
+	s := NewSender(host, Port(port), Auth("user", "secret-pass"), Transcript(TranscriptToError))
+	err := s.Send("test body", Params{From: "from@example.com", To: []string{"to@example.com"}})
+	waitSMTPTestServer(t, done)
+	require.Error(t, err)
+
+	var trErr *TranscriptError
+	require.ErrorAs(t, err, &trErr)
+	assert.Equal(t, strings.Join([]string{
+		"S: 220 smtp.example.net ESMTP ready",
+		"C: EHLO localhost",
+		"S: 250-smtp.example.net",
+		"S: 250 AUTH PLAIN",
+		"C: AUTH PLAIN [REDACTED]",
+		"S: 235 accepted",
+		"C: MAIL FROM:<from@example.com>",
+		"S: 250 ok",
+		"C: RCPT TO:<to@example.com>",
+		"S: 550 no such user here",
+	}, "\n"), trErr.Transcript)
+	assert.Contains(t, err.Error(), "bad to address")
+	assert.Contains(t, err.Error(), ", smtp transcript:\nS: 220 smtp.example.net ESMTP ready\n")
+	var phErr *phaseError
+	assert.ErrorAs(t, err, &phErr, "transcript error unwraps")
+}
+
+func TestEmail_TranscriptToLogSTARTTLS(t *testing.T) {
+	host, port, done := startSMTPTestServer(t, transcriptTestHandler(smtpTestTLSConfig(t), []transcriptTestStep{
+		{"EHLO localhost", "250-smtp.example.net\r\n250 STARTTLS"},
+		{"STARTTLS", "220 go ahead"},
+		{"EHLO localhost", "250-smtp.example.net\r\n250 AUTH LOGIN"},
+		{"AUTH LOGIN", "334 VXNlcm5hbWU6"},
+		{"", "334 UGFzc3dvcmQ6"},
+		{"", "235 accepted"},
+		{"MAIL FROM:<from@example.com>", "250 ok"},
+		{"RCPT TO:<to@example.com>", "250 ok"},
+		{"DATA", "354 go ahead"},
+		{".", "250 queued"},
+		{"QUIT", "221 bye"},
+	}))
+
+	logBuff := bytes.NewBuffer(nil)
+	s := NewSender("smtp.example.net", Port(port), STARTTLS(true), InsecureSkipVerify(true), Auth("user", "secret-pass"),
+		LoginAuth(), LogBody(BodyLogOff), Transcript(TranscriptToLog|TranscriptToError), Log(newTestLogger(logBuff)),
+		DialContext(func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort(host, fmt.Sprint(port)))
+		}))
+	require.NoError(t, s.Send("secret body", Params{From: "from@example.com", To: []string{"to@example.com"}, Subject: "subj"}))
+	waitSMTPTestServer(t, done)
+
+	log := logBuff.String()
+	assert.Contains(t, log, "[DEBUG] smtp transcript of smtp.example.net:"+fmt.Sprint(port)+":\n")
+	assert.Contains(t, log, "C: STARTTLS\nS: 220 go ahead\n-- [TLS started, TLS1.3]\nC: EHLO localhost\nS: 250-smtp.example.net\nS: 250 AUTH LOGIN\n")
+	assert.Contains(t, log, "C: AUTH LOGIN [REDACTED]\nS: 334 VXNlcm5hbWU6\nC: [REDACTED]\nS: 334 UGFzc3dvcmQ6\nC: [REDACTED]\nS: 235 accepted\n")
+	assert.Regexp(t, `S: 354 go ahead\nC: \[message data, \d+ bytes\]\nC: \.\nS: 250 queued\n`, log)
+	assert.NotContains(t, log, "secret body")
+	assert.NotContains(t, log, "secret-pass")
+}
+
+func TestEmail_ClientSTARTTLSRecorded(t *testing.T) {
+	serverTLS := smtpTestTLSConfig(t)
+	otherTLS := smtpTestTLSConfig(t)
+
+	tests := []struct {
+		name    string
+		reply   string // to STARTTLS
+		server  *tls.Config
+		options []Option
+		wantErr string
+	}{
+		{name: "rejected by the server", reply: "454 TLS not available", options: []Option{InsecureSkipVerify(true)},
+			wantErr: `454 "TLS not available"`},
+		{name: "untrusted certificate", reply: "220 go ahead", server: serverTLS,
+			wantErr: "failed to verify certificate"},
+		{name: "pin mismatch", reply: "220 go ahead", server: serverTLS,
+			options: []Option{InsecureSkipVerify(true), PinSPKI(testSPKIPin(t, otherTLS.Certificates[0].Certificate[0]))},
+			wantErr: "doesn't match any pinned SPKI hash"},
+		{name: "min version above the server's", reply: "220 go ahead",
+			server:  &tls.Config{Certificates: serverTLS.Certificates, MaxVersion: tls.VersionTLS12}, // #nosec G402
+			options: []Option{InsecureSkipVerify(true), TLSConfig(&tls.Config{MinVersion: tls.VersionTLS13})},
+			wantErr: "protocol version not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := []string{}
+			for _, recorded := range []bool{false, true} {
+				host, port, done := startSMTPTestServer(t, func(conn net.Conn) error {
+					if err := writeSMTPResponse(conn, "220 smtp.example.net ESMTP ready"); err != nil {
+						return err
+					}
+					reader := bufio.NewReader(conn)
+					if _, err := readSMTPCommand(reader); err != nil {
+						return err
+					}
+					if err := writeSMTPResponse(conn, "250-smtp.example.net\r\n250 STARTTLS"); err != nil {
+						return err
+					}
+					if cmd, err := readSMTPCommand(reader); err != nil || cmd != "STARTTLS" {
+						return fmt.Errorf("unexpected command %q, %v", cmd, err)
+					}
+					if err := writeSMTPResponse(conn, tt.reply); err != nil {
+						return err
+					}
+					if strings.HasPrefix(tt.reply, "220") {
+						_ = tls.Server(conn, tt.server).Handshake() // failed handshake is checked on the client side
+					}
+					return nil
+				})
+
+				s := NewSender("smtp.example.net", append([]Option{Port(port), STARTTLS(true),
+					Transcript(TranscriptToError), DialContext(func(ctx context.Context, network, _ string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort(host, fmt.Sprint(port)))
+					})}, tt.options...)...)
+				var rec *transcript
+				if recorded {
+					rec = s.newTranscript()
+				}
+				_, _, err := s.client(context.Background(), rec)
+				waitSMTPTestServer(t, done)
+				require.Error(t, err, "recorded: %v", recorded)
+				assert.True(t, strings.HasPrefix(err.Error(), "failed to start tls: "), "recorded: %v, %v", recorded, err)
+				assert.Contains(t, err.Error(), tt.wantErr, "recorded: %v", recorded)
+				errs = append(errs, err.Error())
+			}
+			assert.Equal(t, errs[0], errs[1], "the same error with and without the transcript")
+		})
+	}
+}
+
+func TestTranscript_clientWrite(t *testing.T) {
+	rec := &transcript{}
+	rec.clientWrite([]byte("EHLO local"))
+	rec.clientWrite([]byte("host\r\nAUTH PLAIN\r\n"))
+	rec.serverRead([]byte("334 \r\n"))
+	rec.clientWrite([]byte("AHVzZXIAcGFzcw==\r\n"))
+	rec.serverRead([]byte("535 bad\r\n"))
+	rec.clientWrite([]byte("auth plain AHVzZXIAcGFzcw==\r\nNOOP\r\n"))
+	assert.Equal(t, "C: EHLO localhost\nC: AUTH PLAIN\nS: 334 \nC: [REDACTED]\nS: 535 bad\nC: auth plain [REDACTED]\nC: [REDACTED]", rec.String(),
+		"client lines are redacted until the server ends AUTH exchange")
+	assert.Nil(t, (*transcript)(nil).authTLSState(nil))
+}
+
+type transcriptTestStep struct {
+	expect string // command prefix, empty for any AUTH continuation line
+	reply  string
+}
+
+// transcriptTestHandler serves the scripted session, upgrading to TLS after 220 reply to STARTTLS
+func transcriptTestHandler(tlsConf *tls.Config, steps []transcriptTestStep) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		if err := writeSMTPResponse(conn, "220 smtp.example.net ESMTP ready"); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		for i := 0; i < len(steps); i++ {
+			step := steps[i]
+			cmd, err := readSMTPCommand(reader)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(cmd, step.expect) {
+				return fmt.Errorf("unexpected command %q, want %q", cmd, step.expect)
+			}
+			if err = writeSMTPResponse(conn, step.reply); err != nil {
+				return err
+			}
+			switch {
+			case cmd == "STARTTLS" && strings.HasPrefix(step.reply, "220"):
+				tlsConn := tls.Server(conn, tlsConf)
+				if err = tlsConn.Handshake(); err != nil {
+					return err
+				}
+				conn, reader = tlsConn, bufio.NewReader(tlsConn)
+			case cmd == "DATA":
+				if err = readSMTPData(reader); err != nil {
+					return err
+				}
+				i++ // the terminating dot is read with the data, the next step replies to it
+				if err = writeSMTPResponse(conn, steps[i].reply); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}